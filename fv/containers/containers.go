@@ -15,62 +15,204 @@
 package containers
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"text/template"
 	"time"
 
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	dockerclient "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	log "github.com/sirupsen/logrus"
 
-	"github.com/projectcalico/felix/fv/utils"
 	"github.com/projectcalico/libcalico-go/lib/set"
 )
 
+// dockerCli is the single Docker Engine API client used by every Container helper in
+// this package. The API version is negotiated against the daemon once, at package
+// init, rather than on every call.
+var dockerCli *dockerclient.Client
+
+func init() {
+	var err error
+	dockerCli, err = dockerclient.NewClientWithOpts(dockerclient.FromEnv, dockerclient.WithAPIVersionNegotiation())
+	if err != nil {
+		log.WithError(err).Panic("Failed to create docker client")
+	}
+
+	trapSignals()
+}
+
 type Container struct {
 	Name     string
+	ID       string
 	IP       string
 	Hostname string
-	runCmd   *exec.Cmd
 
 	binariesMutex sync.Mutex
 	binaries      set.Set
 }
 
+// HealthCheck describes a docker HEALTHCHECK to attach to a container started via
+// RunWithHealthCheck, so that callers can wait on WaitReady instead of racing a
+// half-initialised daemon.
+type HealthCheck struct {
+	Cmd         string
+	Interval    time.Duration
+	Retries     int
+	StartPeriod time.Duration
+}
+
 var containerIdx = 0
 
-var runningContainers = []*Container{}
+// runningContainers is mutated by Run/Stop, which can be called concurrently from
+// parallel Ginkgo nodes, and is also walked by the signal trap below.
+var (
+	runningContainersMutex sync.Mutex
+	runningContainers      = []*Container{}
+)
+
+// trapSignals installs a handler for SIGINT/SIGTERM/SIGQUIT so that a developer hitting
+// Ctrl-C (or CI killing the process) mid-run doesn't leak felix/etcd/workload containers
+// that block the next run. Borrowed from the pattern in Docker's own pkg/signal.Trap: the
+// first signal tears down runningContainers and exits with the conventional 128+signal
+// code; a third repeat of the same signal skips cleanup and exits immediately, so a
+// wedged docker daemon can't trap the developer at their terminal.
+func trapSignals() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	go func() {
+		var repeats int
+		var last os.Signal
+		var cleaning bool
+		for sig := range sigCh {
+			if sig == last {
+				repeats++
+			} else {
+				last = sig
+				repeats = 1
+			}
+			if repeats >= 3 {
+				log.WithField("signal", sig).Warn("Received signal 3 times, exiting immediately without cleanup")
+				os.Exit(128 + int(sig.(syscall.Signal)))
+			}
+
+			if cleaning {
+				continue
+			}
+			cleaning = true
+
+			// Clean up in the background so this loop keeps reading signals and
+			// can still honour a third repeat while cleanup is in progress.
+			go func(sig os.Signal) {
+				log.WithField("signal", sig).Warn("Received signal, stopping running containers")
+				runningContainersMutex.Lock()
+				toStop := append([]*Container{}, runningContainers...)
+				runningContainersMutex.Unlock()
+
+				var wg sync.WaitGroup
+				for _, c := range toStop {
+					wg.Add(1)
+					go func(c *Container) {
+						defer wg.Done()
+						done := make(chan struct{})
+						go func() {
+							c.Stop()
+							close(done)
+						}()
+						select {
+						case <-done:
+						case <-time.After(10 * time.Second):
+							log.WithField("container", c.Name).Warn("Timed out stopping container after signal")
+						}
+					}(c)
+				}
+				wg.Wait()
+
+				os.Exit(128 + int(sig.(syscall.Signal)))
+			}(sig)
+		}
+	}()
+}
 
 func (c *Container) Stop() {
 	if c == nil {
 		log.Info("Stop no-op because nil container")
-	} else if c.runCmd == nil {
+		return
+	}
+	if c.ID == "" {
 		log.WithField("container", c.Name).Info("Stop no-op because container is not running")
-	} else {
-		log.WithField("container", c).Info("Stop")
-		utils.Run("docker", "stop", c.Name)
-		c.runCmd = nil
+		return
+	}
 
-		// And now to be really sure that the container is cleaned up.
-		utils.RunMayFail("docker", "rm", "-f", c.Name)
+	log.WithField("container", c).Info("Stop")
+	timeout := 5 * time.Second
+	err := dockerCli.ContainerStop(context.Background(), c.ID, &timeout)
+	if err != nil && !dockerclient.IsErrNotFound(err) {
+		Expect(err).NotTo(HaveOccurred())
+	}
+	c.ID = ""
+
+	// And now to be really sure that the container is cleaned up.
+	err = dockerCli.ContainerRemove(context.Background(), c.Name, types.ContainerRemoveOptions{Force: true})
+	if err != nil && !dockerclient.IsErrNotFound(err) {
+		log.WithError(err).WithField("container", c.Name).Warn("Failed to remove container")
+	}
+
+	runningContainersMutex.Lock()
+	defer runningContainersMutex.Unlock()
+	for i, rc := range runningContainers {
+		if rc == c {
+			runningContainers = append(runningContainers[:i], runningContainers[i+1:]...)
+			break
+		}
 	}
 }
 
 func Run(namePrefix string, args ...string) (c *Container) {
+	return RunWithHealthCheck(namePrefix, nil, args...)
+}
+
+// RunWithHealthCheck is like Run but additionally attaches hc (if non-nil) to the
+// container as a docker HEALTHCHECK, so the caller can wait on WaitReady rather than
+// just WaitRunning.
+func RunWithHealthCheck(namePrefix string, hc *HealthCheck, args ...string) (c *Container) {
 
 	// Build unique container name and struct.
 	containerIdx++
 	c = &Container{Name: fmt.Sprintf("%v-%d-%d-", namePrefix, os.Getpid(), containerIdx)}
 
+	config, hostConfig := parseRunArgs(args)
+	if hc != nil {
+		config.Healthcheck = &container.HealthConfig{
+			Test:        []string{"CMD-SHELL", hc.Cmd},
+			Interval:    hc.Interval,
+			Retries:     hc.Retries,
+			StartPeriod: hc.StartPeriod,
+		}
+	}
+
 	// Start the container.
 	log.WithField("container", c.Name).Info("About to run container")
-	runArgs := append([]string{"run", "--name", c.Name}, args...)
-	c.runCmd = exec.Command("docker", runArgs...)
-	err := c.runCmd.Start()
+	ctx := context.Background()
+	created, err := dockerCli.ContainerCreate(ctx, config, hostConfig, nil, c.Name)
+	Expect(err).NotTo(HaveOccurred())
+	c.ID = created.ID
+
+	err = dockerCli.ContainerStart(ctx, c.ID, types.ContainerStartOptions{})
 	Expect(err).NotTo(HaveOccurred())
 
 	// It might take a very long time for the container to show as running, if the image needs
@@ -78,7 +220,9 @@ func Run(namePrefix string, args ...string) (c *Container) {
 	c.WaitRunning(20 * 60 * time.Second)
 
 	// Remember that this container is now running.
+	runningContainersMutex.Lock()
 	runningContainers = append(runningContainers, c)
+	runningContainersMutex.Unlock()
 
 	// Fill in rest of container struct.
 	c.IP = c.GetIP()
@@ -88,63 +232,153 @@ func Run(namePrefix string, args ...string) (c *Container) {
 	return
 }
 
+// parseRunArgs translates the subset of `docker run` flags that the fv suite uses
+// (-e/--env, -v/--volume, --privileged, --health-*) plus a trailing image and command,
+// into the equivalent Engine API config structs.
+func parseRunArgs(args []string) (*container.Config, *container.HostConfig) {
+	cfg := &container.Config{}
+	hostCfg := &container.HostConfig{}
+
+	healthcheck := func() *container.HealthConfig {
+		if cfg.Healthcheck == nil {
+			cfg.Healthcheck = &container.HealthConfig{}
+		}
+		return cfg.Healthcheck
+	}
+
+	i := 0
+	for i < len(args) {
+		arg := args[i]
+		switch arg {
+		case "-e", "--env":
+			cfg.Env = append(cfg.Env, args[i+1])
+			i += 2
+		case "-v", "--volume":
+			hostCfg.Binds = append(hostCfg.Binds, args[i+1])
+			i += 2
+		case "--privileged":
+			hostCfg.Privileged = true
+			i++
+		case "--health-cmd":
+			healthcheck().Test = []string{"CMD-SHELL", args[i+1]}
+			i += 2
+		case "--health-interval":
+			d, err := time.ParseDuration(args[i+1])
+			Expect(err).NotTo(HaveOccurred())
+			healthcheck().Interval = d
+			i += 2
+		case "--health-retries":
+			n, err := strconv.Atoi(args[i+1])
+			Expect(err).NotTo(HaveOccurred())
+			healthcheck().Retries = n
+			i += 2
+		case "--health-start-period":
+			d, err := time.ParseDuration(args[i+1])
+			Expect(err).NotTo(HaveOccurred())
+			healthcheck().StartPeriod = d
+			i += 2
+		default:
+			// First non-flag argument is the image; everything after it is the
+			// command to run inside the container.
+			cfg.Image = arg
+			cfg.Cmd = args[i+1:]
+			i = len(args)
+		}
+	}
+
+	return cfg, hostCfg
+}
+
+func (c *Container) inspect() types.ContainerJSON {
+	details, err := dockerCli.ContainerInspect(context.Background(), c.ID)
+	Expect(err).NotTo(HaveOccurred())
+	return details
+}
+
+// DockerInspect renders `format` as a text/template against the container's
+// types.ContainerJSON, mirroring `docker inspect --format`.
 func (c *Container) DockerInspect(format string) string {
-	inspectCmd := exec.Command("docker", "inspect",
-		"--format="+format,
-		c.Name,
-	)
-	outputBytes, err := inspectCmd.CombinedOutput()
+	tmpl, err := template.New("inspect").Parse(format)
 	Expect(err).NotTo(HaveOccurred())
-	return string(outputBytes)
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, c.inspect())
+	Expect(err).NotTo(HaveOccurred())
+	return buf.String()
 }
 
 func (c *Container) GetIP() string {
-	output := c.DockerInspect("{{range .NetworkSettings.Networks}}{{.IPAddress}}{{end}}")
-	return strings.TrimSpace(output)
+	details := c.inspect()
+	for _, network := range details.NetworkSettings.Networks {
+		return network.IPAddress
+	}
+	return ""
 }
 
 func (c *Container) GetHostname() string {
-	output := c.DockerInspect("{{.Config.Hostname}}")
-	return strings.TrimSpace(output)
+	return c.inspect().Config.Hostname
 }
 
 func (c *Container) WaitRunning(timeout time.Duration) {
-	log.Info("Wait for container to be listed in docker ps")
+	log.Info("Wait for container to be running")
 	start := time.Now()
 	for {
-		cmd := exec.Command("docker", "ps")
-		out, err := cmd.CombinedOutput()
-		Expect(err).NotTo(HaveOccurred())
-		if strings.Contains(string(out), c.Name) {
+		details, err := dockerCli.ContainerInspect(context.Background(), c.ID)
+		if err == nil && details.State.Running {
 			break
 		}
 		if time.Since(start) > timeout {
-			log.WithField("container", c.Name).Panic("Timed out waiting for container to be listed.")
+			log.WithField("container", c.Name).Panic("Timed out waiting for container to be running.")
 		}
+		time.Sleep(100 * time.Millisecond)
 	}
 }
 
 func (c *Container) WaitNotRunning(timeout time.Duration) {
-	log.Info("Wait for container not to be listed in docker ps")
+	log.Info("Wait for container to stop")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	statusCh, errCh := dockerCli.ContainerWait(ctx, c.ID, container.WaitConditionNotRunning)
+	select {
+	case err := <-errCh:
+		if ctx.Err() != nil {
+			log.WithField("container", c.Name).Panic("Timed out waiting for container not to be running.")
+		}
+		Expect(err).NotTo(HaveOccurred())
+	case <-statusCh:
+	}
+}
+
+// WaitReady waits for the container's HEALTHCHECK (set via RunWithHealthCheck) to
+// report "healthy", failing fast if it ever reports "unhealthy". Containers with no
+// HEALTHCHECK configured have no health status and so this blocks until timeout;
+// callers without a health probe should use WaitRunning instead.
+func (c *Container) WaitReady(timeout time.Duration) {
+	log.Info("Wait for container to become healthy")
 	start := time.Now()
 	for {
-		cmd := exec.Command("docker", "ps")
-		out, err := cmd.CombinedOutput()
-		Expect(err).NotTo(HaveOccurred())
-		if !strings.Contains(string(out), c.Name) {
-			break
+		details := c.inspect()
+		if details.State.Health != nil {
+			switch details.State.Health.Status {
+			case types.Healthy:
+				return
+			case types.Unhealthy:
+				log.WithField("container", c.Name).Panic("Container reported unhealthy.")
+			}
 		}
 		if time.Since(start) > timeout {
-			log.WithField("container", c.Name).Panic("Timed out waiting for container not to be listed.")
+			log.WithField("container", c.Name).Panic("Timed out waiting for container to become healthy.")
 		}
+		time.Sleep(100 * time.Millisecond)
 	}
 }
 
 var _ = AfterEach(func() {
-	for _, c := range runningContainers {
+	runningContainersMutex.Lock()
+	toStop := append([]*Container{}, runningContainers...)
+	runningContainersMutex.Unlock()
+	for _, c := range toStop {
 		c.Stop()
 	}
-	runningContainers = []*Container{}
 })
 
 func (c *Container) EnsureBinary(name string) {
@@ -152,21 +386,176 @@ func (c *Container) EnsureBinary(name string) {
 	defer c.binariesMutex.Unlock()
 
 	if !c.binaries.Contains(name) {
-		exec.Command("docker", "cp", "../bin/"+name, c.Name+":/"+name).Run()
+		content, err := tarFile("../bin/"+name, name)
+		Expect(err).NotTo(HaveOccurred())
+		err = dockerCli.CopyToContainer(context.Background(), c.ID, "/", content, types.CopyToContainerOptions{})
+		Expect(err).NotTo(HaveOccurred())
 		c.binaries.Add(name)
 	}
 }
 
+// tarFile reads hostPath and wraps it in a tar stream containing a single file at
+// containerPath, suitable for passing to the Engine API's CopyToContainer.
+func tarFile(hostPath, containerPath string) (io.Reader, error) {
+	data, err := ioutil.ReadFile(hostPath)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	hdr := &tar.Header{
+		Name: strings.TrimPrefix(containerPath, "/"),
+		Mode: 0755,
+		Size: int64(len(data)),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+// ExitError is returned by ExecOutput and ExecPrivileged when the command ran
+// to completion but exited non-zero, so callers can inspect the exit code
+// without having to re-parse it out of an error string.
+type ExitError struct {
+	Cmd      []string
+	ExitCode int
+	Stdout   string
+	Stderr   string
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("command %v exited with code %d", e.Cmd, e.ExitCode)
+}
+
+// execCapture runs cmd inside the container and returns its demultiplexed stdout,
+// stderr and exit code.
+func (c *Container) execCapture(ctx context.Context, cmd []string, privileged bool) (stdout, stderr string, exitCode int, err error) {
+	execID, err := dockerCli.ContainerExecCreate(ctx, c.ID, types.ExecConfig{
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+		Privileged:   privileged,
+	})
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	resp, err := dockerCli.ContainerExecAttach(ctx, execID.ID, types.ExecStartCheck{})
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer resp.Close()
+
+	var outBuf, errBuf bytes.Buffer
+	if _, err = stdcopy.StdCopy(&outBuf, &errBuf, resp.Reader); err != nil {
+		return "", "", 0, err
+	}
+
+	inspect, err := dockerCli.ContainerExecInspect(ctx, execID.ID)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	return outBuf.String(), errBuf.String(), inspect.ExitCode, nil
+}
+
+// execOutput is the shared implementation behind ExecOutput and ExecPrivileged:
+// it runs cmd and turns a non-zero exit code into an *ExitError.
+func (c *Container) execOutput(ctx context.Context, cmd []string, privileged bool) (stdout, stderr string, err error) {
+	stdout, stderr, exitCode, err := c.execCapture(ctx, cmd, privileged)
+	if err != nil {
+		return stdout, stderr, err
+	}
+	if exitCode != 0 {
+		return stdout, stderr, &ExitError{Cmd: cmd, ExitCode: exitCode, Stdout: stdout, Stderr: stderr}
+	}
+	return stdout, stderr, nil
+}
+
 func (c *Container) Exec(cmd ...string) {
-	arg := []string{"exec", c.Name}
-	arg = append(arg, cmd...)
-	utils.Run("docker", arg...)
+	stdout, stderr, exitCode, err := c.execCapture(context.Background(), cmd, false)
+	Expect(err).NotTo(HaveOccurred())
+	log.WithFields(log.Fields{"cmd": cmd, "stdout": stdout, "stderr": stderr}).Info("Exec")
+	Expect(exitCode).To(BeZero(), "Exec of %v failed with output:\nstdout: %v\nstderr: %v", cmd, stdout, stderr)
 }
 
 func (c *Container) ExecMayFail(cmd ...string) {
-	arg := []string{"exec", c.Name}
-	arg = append(arg, cmd...)
-	utils.RunMayFail("docker", arg...)
+	stdout, stderr, exitCode, err := c.execCapture(context.Background(), cmd, false)
+	Expect(err).NotTo(HaveOccurred())
+	log.WithFields(log.Fields{"cmd": cmd, "stdout": stdout, "stderr": stderr, "exitCode": exitCode}).Info("Exec (may fail)")
+}
+
+// ExecOutput runs cmd inside the container and returns its captured stdout and
+// stderr. Unlike Exec, a non-zero exit doesn't fail the test directly: it's
+// reported as an *ExitError so the caller can assert on it itself.
+func (c *Container) ExecOutput(cmd ...string) (stdout, stderr string, err error) {
+	stdout, stderr, err = c.execOutput(context.Background(), cmd, false)
+	log.WithFields(log.Fields{"cmd": cmd, "stdout": stdout, "stderr": stderr}).Info("ExecOutput")
+	return stdout, stderr, err
+}
+
+// ExecPrivileged is ExecOutput with `--privileged` exec semantics, for the few
+// nftables/conntrack fv scenarios that need capabilities the container wasn't
+// started with.
+func (c *Container) ExecPrivileged(cmd ...string) (stdout, stderr string, err error) {
+	stdout, stderr, err = c.execOutput(context.Background(), cmd, true)
+	log.WithFields(log.Fields{"cmd": cmd, "stdout": stdout, "stderr": stderr}).Info("ExecPrivileged")
+	return stdout, stderr, err
+}
+
+// ExecStream runs cmd inside the container and returns its stdout/stderr as
+// live pipes, for long-running commands (tcpdump, `felix -dump-status`) whose
+// output a test wants to consume line-by-line while it's still running. The
+// returned wait func blocks until the command's output has been fully
+// demultiplexed and returns an *ExitError if it exited non-zero.
+func (c *Container) ExecStream(ctx context.Context, cmd ...string) (stdout, stderr io.ReadCloser, wait func() error, err error) {
+	execID, err := dockerCli.ContainerExecCreate(ctx, c.ID, types.ExecConfig{
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	resp, err := dockerCli.ContainerExecAttach(ctx, execID.ID, types.ExecStartCheck{})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	outR, outW := io.Pipe()
+	errR, errW := io.Pipe()
+	copyDone := make(chan error, 1)
+	go func() {
+		_, copyErr := stdcopy.StdCopy(outW, errW, resp.Reader)
+		outW.CloseWithError(copyErr)
+		errW.CloseWithError(copyErr)
+		resp.Close()
+		copyDone <- copyErr
+	}()
+
+	wait = func() error {
+		if copyErr := <-copyDone; copyErr != nil {
+			return copyErr
+		}
+		inspect, err := dockerCli.ContainerExecInspect(context.Background(), execID.ID)
+		if err != nil {
+			return err
+		}
+		if inspect.ExitCode != 0 {
+			return &ExitError{Cmd: cmd, ExitCode: inspect.ExitCode}
+		}
+		return nil
+	}
+
+	return outR, errR, wait, nil
 }
 
 func (c *Container) SourceName() string {
@@ -178,25 +567,6 @@ func (c *Container) CanConnectTo(ip, port string) bool {
 	// Ensure that the container has the 'test-connection' binary.
 	c.EnsureBinary("test-connection")
 
-	// Run 'test-connection' to the target.
-	connectionCmd := exec.Command("docker", "exec", c.Name,
-		"/test-connection", "-", ip, port)
-	outPipe, err := connectionCmd.StdoutPipe()
-	Expect(err).NotTo(HaveOccurred())
-	errPipe, err := connectionCmd.StderrPipe()
-	Expect(err).NotTo(HaveOccurred())
-	err = connectionCmd.Start()
-	Expect(err).NotTo(HaveOccurred())
-
-	wOut, err := ioutil.ReadAll(outPipe)
-	Expect(err).NotTo(HaveOccurred())
-	wErr, err := ioutil.ReadAll(errPipe)
-	Expect(err).NotTo(HaveOccurred())
-	err = connectionCmd.Wait()
-
-	log.WithFields(log.Fields{
-		"stdout": string(wOut),
-		"stderr": string(wErr)}).WithError(err).Info("Connection test")
-
+	_, _, err := c.ExecOutput("/test-connection", "-", ip, port)
 	return err == nil
 }
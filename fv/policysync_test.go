@@ -1,3 +1,4 @@
+//go:build fvtests
 // +build fvtests
 
 // Copyright (c) 2018 Tigera, Inc. All rights reserved.
@@ -24,6 +25,9 @@ import (
 	"os"
 	"reflect"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/colabsaumoh/proto-udsuspver/nodeagentmgmt"
@@ -33,10 +37,13 @@ import (
 	"github.com/projectcalico/libcalico-go/lib/options"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/projectcalico/felix/dataplane/mock"
 	"github.com/projectcalico/libcalico-go/lib/set"
 
+	"github.com/projectcalico/felix/policysync"
 	"github.com/projectcalico/felix/proto"
 
 	"github.com/projectcalico/felix/fv/containers"
@@ -138,6 +145,8 @@ var _ = Context("policy sync API tests", func() {
 			hostWlSocketPath, containerWlSocketPath [3]string
 		)
 
+		var wlToken [3]string
+
 		dirNameForWorkload := func(wl *workload.Workload) string {
 			return "ps-" + wl.WorkloadEndpoint.Spec.Pod
 		}
@@ -174,8 +183,9 @@ var _ = Context("policy sync API tests", func() {
 					containerWlSocketPath[i] = containerWlDir + "/policysync.sock"
 
 					// Tell Felix about the new directory.
-					_, err := sendCreate(wl)
+					resp, err := sendCreate(wl)
 					Expect(err).NotTo(HaveOccurred())
+					wlToken[i] = resp.Token
 				}
 			})
 
@@ -236,7 +246,7 @@ var _ = Context("policy sync API tests", func() {
 							client := newMockWorkloadClient(fmt.Sprintf("workload-%d", i))
 							var wlCtx context.Context
 							wlCtx, mockWlCancel[i] = context.WithCancel(ctx)
-							client.StartSyncing(wlCtx, wlClient[i])
+							client.StartSyncing(wlCtx, wlClient[i], wlToken[i], nil)
 							mockWlClient[i] = client
 						}
 					})
@@ -312,6 +322,36 @@ var _ = Context("policy sync API tests", func() {
 							// one or two updates through.
 							doChurn(0, 1)
 						})
+
+						It("should resume the dropped connection without churning unrelated workloads", func() {
+							resumeToken := mockWlClient[2].ResumeToken()
+							Expect(resumeToken).NotTo(BeNil())
+
+							before := atomic.LoadInt64(&mockWlClient[1].ReceivedCount)
+
+							// Reconnect workload 2 and resume instead of forcing a full resync.
+							wlConn[2], wlClient[2] = createWorkloadConn(2)
+							resumed := newMockWorkloadClient("workload-2 resumed")
+							resumed.StartSyncing(ctx, wlClient[2], wlToken[2], resumeToken)
+							mockWlClient[2] = resumed
+
+							policy := api.NewGlobalNetworkPolicy()
+							policy.SetName("policy-resume")
+							policy.Spec.Selector = w[2].NameSelector()
+							_, err = calicoClient.GlobalNetworkPolicies().Create(ctx, policy, utils.NoOptions)
+							Expect(err).NotTo(HaveOccurred())
+
+							Eventually(mockWlClient[2].ActivePolicies).Should(Equal(set.From(
+								proto.PolicyID{Name: "default.policy-resume", Tier: "default"})))
+
+							// A successful resume only replays what changed for workload 2; it
+							// shouldn't trigger a full resync that fans out to every other stream,
+							// so workload 1 should not have seen a single extra message.
+							Consistently(func() int64 { return atomic.LoadInt64(&mockWlClient[1].ReceivedCount) }).Should(Equal(before))
+
+							cancel()
+							Eventually(resumed.Done).Should(BeClosed())
+						})
 					})
 
 					Context("after adding a policy that applies to workload 0 only", func() {
@@ -423,11 +463,89 @@ var _ = Context("policy sync API tests", func() {
 							Consistently(mockWlClient[2].ActiveProfiles).Should(Equal(set.From(defProfID)))
 						})
 					})
+
+					Context("after adding a policy large enough to require chunking", func() {
+						// FELIX_PolicySyncMaxMessageBytes defaults to 3MiB; a policy with 16
+						// rules, each carrying a ~1MiB selector, comes to about 16MiB once
+						// marshaled, forcing Felix to split the update into
+						// ChunkBegin/Chunk/ChunkEnd frames (see policysync.Processor.sendMsg).
+						BeforeEach(func() {
+							policy := api.NewGlobalNetworkPolicy()
+							policy.SetName("policy-huge")
+							policy.Spec.Selector = w[0].NameSelector()
+							// A selector string is free-form, so padding it out is a simple way
+							// to inflate the marshaled rule size without depending on any other
+							// optional field of api.Rule.
+							bigSelector := "all() && has(" + strings.Repeat("x", 1<<20) + ")" // ~1MiB
+							for i := 0; i < 16; i++ {
+								policy.Spec.Egress = append(policy.Spec.Egress, api.Rule{
+									Action: api.Allow,
+									Source: api.EntityRule{Selector: bigSelector},
+								})
+							}
+							_, err = calicoClient.GlobalNetworkPolicies().Create(ctx, policy, utils.NoOptions)
+							Expect(err).NotTo(HaveOccurred())
+						})
+
+						It("should be delivered in full to workload 0 without blocking workload 1", func() {
+							// Reassembly is transparent (proto.PolicySync_SyncClient.Recv splices
+							// the chunks back together), so the only client-visible difference
+							// from a small update is that it eventually shows up.
+							Eventually(mockWlClient[0].ActivePolicies, "30s").Should(ContainElement(
+								proto.PolicyID{Name: "default.policy-huge", Tier: "default"}))
+
+							// Workload 1, which isn't selected by the huge policy, should keep
+							// receiving its own unrelated updates promptly rather than stalling
+							// behind workload 0's chunked transfer.
+							before := atomic.LoadInt64(&mockWlClient[1].ReceivedCount)
+							policy := api.NewGlobalNetworkPolicy()
+							policy.SetName("policy-1")
+							policy.Spec.Selector = w[1].NameSelector()
+							_, err = calicoClient.GlobalNetworkPolicies().Create(ctx, policy, utils.NoOptions)
+							Expect(err).NotTo(HaveOccurred())
+							Eventually(func() int64 { return atomic.LoadInt64(&mockWlClient[1].ReceivedCount) }).Should(BeNumerically(">", before))
+						})
+					})
+				})
+
+				Context("with bearer token authentication", func() {
+					expectUnauthenticated := func(syncClient proto.PolicySync_SyncClient, err error) {
+						Expect(err).NotTo(HaveOccurred(), "Sync itself isn't expected to fail; the error surfaces on the first Recv")
+						_, recvErr := syncClient.Recv()
+						Expect(recvErr).To(HaveOccurred())
+						Expect(status.Code(recvErr)).To(Equal(codes.Unauthenticated))
+					}
+
+					It("should reject a Sync with no token", func() {
+						syncClient, err := wlClient[0].Sync(ctx, &proto.SyncRequest{})
+						expectUnauthenticated(syncClient, err)
+					})
+
+					It("should reject a Sync with the wrong token", func() {
+						syncClient, err := wlClient[0].Sync(ctx, &proto.SyncRequest{Token: wlToken[1]})
+						expectUnauthenticated(syncClient, err)
+					})
+
+					It("should reject the old token once WorkloadAdded has rotated it", func() {
+						oldToken := wlToken[0]
+
+						resp, err := sendCreate(w[0])
+						Expect(err).NotTo(HaveOccurred())
+						Expect(resp.Token).NotTo(Equal(oldToken))
+
+						syncClient, err := wlClient[0].Sync(ctx, &proto.SyncRequest{Token: oldToken})
+						expectUnauthenticated(syncClient, err)
+
+						syncClient, err = wlClient[0].Sync(ctx, &proto.SyncRequest{Token: resp.Token})
+						Expect(err).NotTo(HaveOccurred())
+						_, err = syncClient.Recv()
+						Expect(err).NotTo(HaveOccurred())
+					})
 				})
 
 				It("a connection should get closed if a second connection is created", func() {
 					// Create first connection manually.
-					syncClient, err := wlClient[0].Sync(ctx, &proto.SyncRequest{})
+					syncClient, err := wlClient[0].Sync(ctx, &proto.SyncRequest{Token: wlToken[0]})
 					Expect(err).NotTo(HaveOccurred())
 					// Get something from the first connection to make sure it's up.
 					_, err = syncClient.Recv()
@@ -435,7 +553,7 @@ var _ = Context("policy sync API tests", func() {
 
 					// Then create a new mock client.
 					client := newMockWorkloadClient("workload-0 second client")
-					client.StartSyncing(ctx, wlClient[0])
+					client.StartSyncing(ctx, wlClient[0], wlToken[0], nil)
 
 					// The new client should take over, getting a full sync.
 					Eventually(client.InSync).Should(BeTrue())
@@ -454,7 +572,7 @@ var _ = Context("policy sync API tests", func() {
 
 				It("a connection should get closed if the workload is removed", func() {
 					client := newMockWorkloadClient("workload-0")
-					client.StartSyncing(ctx, wlClient[0])
+					client.StartSyncing(ctx, wlClient[0], wlToken[0], nil)
 
 					// Workload should be sent over the API.
 					Eventually(client.EndpointToPolicyOrder).Should(Equal(map[string][]mock.TierInfo{"k8s/fv/fv-pod-0/eth0": {}}))
@@ -471,14 +589,173 @@ var _ = Context("policy sync API tests", func() {
 	})
 })
 
+var _ = Context("policy sync API management-socket authz tests", func() {
+	var (
+		etcd               *containers.Container
+		felix              *containers.Felix
+		calicoClient       client.Interface
+		tempDir            string
+		hostMgmtSocketPath string
+		policyFilePath     string
+		mgmtClient         *nodeagentmgmt.Client
+	)
+
+	writePolicy := func(rules string) {
+		// Write to a temp file in the same directory and rename it into place,
+		// rather than writing policyFilePath directly, so the swap is atomic
+		// from NewAuthzWatcher's point of view - exactly the ConfigMap-style
+		// update its directory watch is meant to survive.
+		tmp := policyFilePath + ".tmp"
+		Expect(ioutil.WriteFile(tmp, []byte(rules), 0644)).NotTo(HaveOccurred())
+		Expect(os.Rename(tmp, policyFilePath)).NotTo(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "felixfv")
+		Expect(err).NotTo(HaveOccurred())
+		policyFilePath = tempDir + "/mgmt-authz.json"
+
+		// Start out permissive: peer UID 0 (root) may register any workload.
+		Expect(ioutil.WriteFile(policyFilePath, []byte(`{"rules":[{"peer_uid":0,"namespace":"*","uid_glob":"*","workloadpath_glob":"*"}]}`), 0644)).NotTo(HaveOccurred())
+
+		options := containers.DefaultTopologyOptions()
+		options.ExtraEnvVars["FELIX_PolicySyncManagementSocketPath"] = "/var/run/calico/policy-mgmt.sock"
+		options.ExtraEnvVars["FELIX_PolicySyncWorkloadSocketPathPrefix"] = "/var/run/calico"
+		options.ExtraEnvVars["FELIX_PolicySyncMgmtAuthzPolicyFile"] = "/var/run/calico/mgmt-authz.json"
+		options.ExtraVolumes[tempDir] = "/var/run/calico"
+		felix, etcd, calicoClient = containers.StartSingleNodeEtcdTopology(options)
+
+		hostMgmtSocketPath = tempDir + "/policy-mgmt.sock"
+		Eventually(hostMgmtSocketPath).Should(BeAnExistingFile())
+		felix.Exec("chmod", "a+rw", "/var/run/calico/policy-mgmt.sock")
+		mgmtClient = nodeagentmgmt.ClientUds(hostMgmtSocketPath)
+	})
+
+	AfterEach(func() {
+		felix.Stop()
+		if CurrentGinkgoTestDescription().Failed {
+			etcd.Exec("etcdctl", "ls", "--recursive", "/")
+		}
+		etcd.Stop()
+		if tempDir != "" {
+			Expect(os.RemoveAll(tempDir)).NotTo(HaveOccurred())
+		}
+	})
+
+	addWorkload := func(uid string) (*mgmtintf_v1.Response, error) {
+		return mgmtClient.WorkloadAdded(&mgmtintf_v1.WorkloadInfo{
+			Attrs: &mgmtintf_v1.WorkloadInfo_WorkloadAttributes{
+				Uid:       uid,
+				Namespace: "fv",
+				Workload:  uid,
+			},
+			Workloadpath: "ps-" + uid,
+		})
+	}
+
+	removeWorkload := func(uid string) (*mgmtintf_v1.Response, error) {
+		return mgmtClient.WorkloadRemoved(&mgmtintf_v1.WorkloadInfo{
+			Attrs: &mgmtintf_v1.WorkloadInfo_WorkloadAttributes{
+				Uid:       uid,
+				Namespace: "fv",
+				Workload:  uid,
+			},
+			Workloadpath: "ps-" + uid,
+		})
+	}
+
+	It("should reload the policy after an atomic swap and keep rejecting once restrictive", func() {
+		By("Accepting a WorkloadAdded while the permissive policy is in effect")
+		_, err := addWorkload("authz-wl-0")
+		Expect(err).NotTo(HaveOccurred())
+
+		By("Swapping in a restrictive policy that matches nothing")
+		writePolicy(`{"rules":[]}`)
+
+		By("Rejecting a new WorkloadAdded once the swap has taken effect")
+		Eventually(func() error {
+			_, err := addWorkload("authz-wl-1")
+			return err
+		}, "10s").Should(HaveOccurred())
+	})
+
+	It("should reject a WorkloadRemoved for a peer the policy doesn't authorize", func() {
+		By("Accepting a WorkloadAdded while the permissive policy is in effect")
+		_, err := addWorkload("authz-wl-2")
+		Expect(err).NotTo(HaveOccurred())
+
+		By("Swapping in a restrictive policy that matches nothing")
+		writePolicy(`{"rules":[]}`)
+
+		By("Rejecting a WorkloadRemoved for that same workload once the swap has taken effect")
+		Eventually(func() error {
+			_, err := removeWorkload("authz-wl-2")
+			return err
+		}, "10s").Should(HaveOccurred())
+	})
+})
+
+// Abstract-namespace Unix sockets have no filesystem entry, so they can't be
+// reached via the bind-mounted tempDir the other Contexts in this file use to
+// get from the test process, on the host, into the felix container. They're
+// scoped to the network namespace instead, which the two namespaces don't
+// share. So, unlike the other Contexts here, this one can't dial the socket
+// from the test process; it confirms felix.Listen'd the abstract socket the
+// way nodeagentmgmt.ClientUds/unixDialer would reach it from inside that same
+// namespace, by reading it back out of /proc/net/unix inside the container.
+var _ = Context("policy sync API tests with abstract-namespace sockets", func() {
+	var (
+		etcd  *containers.Container
+		felix *containers.Felix
+	)
+
+	BeforeEach(func() {
+		// No ExtraVolumes: an abstract socket has no filesystem entry for a
+		// bind mount to share in the first place.
+		options := containers.DefaultTopologyOptions()
+		options.ExtraEnvVars["FELIX_PolicySyncManagementSocketPath"] = "unix-abstract:felix-test-policy-mgmt"
+		options.ExtraEnvVars["FELIX_PolicySyncWorkloadSocketPathPrefix"] = "unix-abstract:felix-test-policysync"
+		felix, etcd, _ = containers.StartSingleNodeEtcdTopology(options)
+	})
+
+	AfterEach(func() {
+		felix.Stop()
+		if CurrentGinkgoTestDescription().Failed {
+			etcd.Exec("etcdctl", "ls", "--recursive", "/")
+		}
+		etcd.Stop()
+	})
+
+	It("should listen on the configured abstract-namespace management socket", func() {
+		Eventually(func() string {
+			stdout, _, err := felix.ExecOutput("cat", "/proc/net/unix")
+			Expect(err).NotTo(HaveOccurred())
+			return stdout
+		}, "10s").Should(ContainSubstring("@felix-test-policy-mgmt"))
+	})
+})
+
+// unixDialer recognizes the same "@"/"unix-abstract:" syntax
+// policysync.Listen does, so a workload's PolicySyncClient can dial an
+// abstract-namespace socket the same way it dials a filesystem one.
 func unixDialer(target string, timeout time.Duration) (net.Conn, error) {
-	return net.DialTimeout("unix", target, timeout)
+	return net.DialTimeout("unix", policysync.AbstractSocketName(target), timeout)
 }
 
 type mockWorkloadClient struct {
 	*mock.MockDataplane
 	name string
 	Done chan struct{}
+
+	// ReceivedCount counts every message handed to OnEvent, whether or not it
+	// arrived as a single PolicySync message or was reassembled by
+	// proto.PolicySync_SyncClient from a ChunkBegin/Chunk/ChunkEnd sequence.
+	// Read it with atomic.LoadInt64.
+	ReceivedCount int64
+
+	resumeMu  sync.Mutex
+	resumeTok *proto.ResumeRequest
 }
 
 func newMockWorkloadClient(name string) *mockWorkloadClient {
@@ -489,12 +766,25 @@ func newMockWorkloadClient(name string) *mockWorkloadClient {
 	}
 }
 
-func (c *mockWorkloadClient) StartSyncing(ctx context.Context, policySyncClient proto.PolicySyncClient) {
-	syncClient, err := policySyncClient.Sync(ctx, &proto.SyncRequest{})
+// StartSyncing opens a Sync stream authenticated with token, the bearer token
+// WorkloadAdded returned for this workload, and starts reading from it. resume,
+// if non-nil, asks Felix to replay only the deltas since that (BootID, Seq)
+// instead of sending a full resync; pass nil for a fresh connection.
+func (c *mockWorkloadClient) StartSyncing(ctx context.Context, policySyncClient proto.PolicySyncClient, token string, resume *proto.ResumeRequest) {
+	syncClient, err := policySyncClient.Sync(ctx, &proto.SyncRequest{Token: token, Resume: resume})
 	Expect(err).NotTo(HaveOccurred())
 	go c.loopReadingFromAPI(ctx, syncClient)
 }
 
+// ResumeToken returns the (BootID, Seq) of the most recent message this
+// client applied, suitable for passing as the resume argument to
+// StartSyncing on a reconnecting client.
+func (c *mockWorkloadClient) ResumeToken() *proto.ResumeRequest {
+	c.resumeMu.Lock()
+	defer c.resumeMu.Unlock()
+	return c.resumeTok
+}
+
 func (c *mockWorkloadClient) loopReadingFromAPI(ctx context.Context, syncClient proto.PolicySync_SyncClient) {
 	defer GinkgoRecover()
 	defer close(c.Done)
@@ -506,6 +796,10 @@ func (c *mockWorkloadClient) loopReadingFromAPI(ctx context.Context, syncClient
 			return
 		}
 		log.WithField("msg", msg).Info("Received workload message")
+		atomic.AddInt64(&c.ReceivedCount, 1)
+		c.resumeMu.Lock()
+		c.resumeTok = &proto.ResumeRequest{BootID: msg.BootID, Seq: msg.SeqNo}
+		c.resumeMu.Unlock()
 		c.OnEvent(reflect.ValueOf(msg.Payload).Elem().Field(0).Interface())
 	}
 }
@@ -0,0 +1,454 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+)
+
+// datastorePollInterval is how often Watch re-resolves Config to pick up
+// datastore changes. Unlike the file source, the datastore can't be watched
+// for changes from this package, so it's polled instead.
+const datastorePollInterval = 30 * time.Second
+
+// Config holds the fully-resolved, typed set of Felix parameters. Fields are
+// populated by a Loader, which merges the configured Sources according to the
+// documented precedence (datastore > environment > file > default) and
+// validates each value using the metadata in its `config` struct tag.
+//
+// Each field's tag may contain:
+//   name=<param>      the lower-case parameter name sources key off (defaults
+//                      to the lower-cased Go field name)
+//   default=<value>   used when no source sets the parameter
+//   validate=<rule>    "non-zero" or "oneof(a,b,c)"
+//   restart=true       changing this field at runtime requires a Felix restart
+type Config struct {
+	FelixHostname string `config:"default=;validate=non-zero;restart=true"`
+
+	DatastoreType string `config:"default=etcdv2;validate=oneof(etcdv2,kubernetes);restart=true"`
+	EtcdAddr      string `config:"default=127.0.0.1:2379"`
+	EtcdScheme    string `config:"default=http;validate=oneof(http,https)"`
+
+	IpInIpEnabled bool `config:"default=false;restart=true"`
+
+	MetadataAddr string `config:"default=127.0.0.1"`
+	MetadataPort int    `config:"default=8775"`
+
+	InterfacePrefix             string `config:"default=cali"`
+	ChainInsertMode             string `config:"default=insert;validate=oneof(insert,append)"`
+	DefaultEndpointToHostAction string `config:"default=DROP;validate=oneof(DROP,RETURN,ACCEPT)"`
+
+	IptablesRefreshInterval time.Duration `config:"default=90s"`
+	ReportingIntervalSecs   int           `config:"default=30"`
+
+	LogSeveritySys    string `config:"default=INFO;validate=oneof(DEBUG,INFO,WARNING,ERROR,NONE)"`
+	LogSeverityScreen string `config:"default=INFO;validate=oneof(DEBUG,INFO,WARNING,ERROR,NONE)"`
+
+	PrometheusMetricsEnabled bool `config:"default=false;restart=true"`
+
+	// PolicySyncManagementSocketPath and PolicySyncWorkloadSocketPathPrefix may
+	// also name a Linux abstract-namespace socket, via a leading "@" or a
+	// "unix-abstract:" prefix; see policysync.Listen.
+	PolicySyncManagementSocketPath     string `config:"default=/var/run/calico/policy-mgmt.sock;restart=true"`
+	PolicySyncWorkloadSocketPathPrefix string `config:"default=/var/run/calico;restart=true"`
+	// PolicySyncResumeBufferSize is the number of recent ToDataplane messages
+	// Felix keeps per workload so a reconnecting client can resume from its
+	// last-seen Seq instead of doing a full resync.
+	PolicySyncResumeBufferSize int `config:"default=50"`
+	// PolicySyncMgmtAuthzPolicyFile points at a JSON file of allow-rules for
+	// the policy-sync management socket; empty disables authorization.
+	PolicySyncMgmtAuthzPolicyFile string `config:"default="`
+	// PolicySyncMaxMessageBytes is the largest marshaled update Felix will
+	// put in a single PolicySync message before splitting it into
+	// Begin/Chunk/End frames; it should stay comfortably under gRPC's default
+	// 4 MiB max message size.
+	PolicySyncMaxMessageBytes int `config:"default=3145728"`
+}
+
+// fieldMetadata is the parsed form of a Config field's `config` struct tag.
+type fieldMetadata struct {
+	Name            string
+	Default         string
+	Validate        string
+	RestartRequired bool
+	FieldIndex      int
+}
+
+// configMetadata is built once from Config's struct tags and reused by every Loader.
+var configMetadata = buildMetadata()
+
+func buildMetadata() []fieldMetadata {
+	var metas []fieldMetadata
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		meta := fieldMetadata{Name: strings.ToLower(f.Name), FieldIndex: i}
+		tag, ok := f.Tag.Lookup("config")
+		if !ok {
+			metas = append(metas, meta)
+			continue
+		}
+		for _, part := range strings.Split(tag, ";") {
+			if part == "" {
+				continue
+			}
+			kv := strings.SplitN(part, "=", 2)
+			if len(kv) != 2 {
+				glog.Warningf("Ignoring malformed config tag segment on %v: %q", f.Name, part)
+				continue
+			}
+			switch kv[0] {
+			case "name":
+				meta.Name = strings.ToLower(kv[1])
+			case "default":
+				meta.Default = kv[1]
+			case "validate":
+				meta.Validate = kv[1]
+			case "restart":
+				meta.RestartRequired = kv[1] == "true"
+			}
+		}
+		metas = append(metas, meta)
+	}
+	return metas
+}
+
+// Source supplies raw, lower-cased Felix parameter values from one configuration
+// origin (environment, file, datastore, ...). A Loader merges its Sources in
+// precedence order to build a Config.
+type Source interface {
+	// Name identifies the source for logging and error messages.
+	Name() string
+	// Load returns the parameter values this source currently holds.
+	Load() (map[string]string, error)
+}
+
+// ConfigUpdate describes a change detected by Loader.Reload.
+type ConfigUpdate struct {
+	Old *Config
+	New *Config
+	// Changed lists the parameter names (as used in Config's struct tags) whose
+	// value differs between Old and New.
+	Changed []string
+	// RestartRequired is true if any changed field is tagged restart=true, in
+	// which case the dataplane driver should be asked for a graceful restart
+	// rather than trying to apply the change live.
+	RestartRequired bool
+}
+
+// Loader merges Config from a fixed set of Sources in documented precedence
+// order - datastore overrides environment, which overrides file, which
+// overrides the struct tag defaults - and makes the result available to
+// callers either synchronously (Load) or as a stream of diffs as the
+// underlying sources change (Reload, Updates).
+type Loader struct {
+	file      Source
+	env       Source
+	datastore Source
+
+	mu      sync.Mutex
+	current *Config
+
+	updates chan ConfigUpdate
+}
+
+// NewLoader builds a Loader from the given sources, any of which may be nil if
+// that source isn't in use.
+func NewLoader(file, env, datastore Source) *Loader {
+	return &Loader{
+		file:      file,
+		env:       env,
+		datastore: datastore,
+		updates:   make(chan ConfigUpdate, 1),
+	}
+}
+
+// Load resolves the current Config from all configured sources. Call it once
+// at start of day; call Reload directly to pick up file/datastore changes on
+// demand, or Watch to have the Loader do so itself.
+func (l *Loader) Load() (*Config, error) {
+	cfg, err := l.resolve()
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	l.current = cfg
+	l.mu.Unlock()
+	return cfg, nil
+}
+
+// Reload re-resolves Config from all sources and, if anything changed since the
+// last Load/Reload, publishes the diff on Updates(). It returns the up-to-date
+// Config either way.
+func (l *Loader) Reload() (*Config, error) {
+	cfg, err := l.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	old := l.current
+	l.current = cfg
+	l.mu.Unlock()
+
+	changed, restartRequired := diffConfig(old, cfg)
+	if len(changed) == 0 {
+		return cfg, nil
+	}
+
+	glog.Infof("Felix config changed: %v (restart required: %v)", changed, restartRequired)
+	update := ConfigUpdate{Old: old, New: cfg, Changed: changed, RestartRequired: restartRequired}
+	select {
+	case l.updates <- update:
+	default:
+		// An earlier update is still unconsumed: replace it with one that spans
+		// both changes, so no changed field (or restart request) is lost.
+		select {
+		case stale := <-l.updates:
+			glog.Warning("Config update channel is full, dropping stale update")
+			changed, restartRequired = diffConfig(stale.Old, cfg)
+			update = ConfigUpdate{Old: stale.Old, New: cfg, Changed: changed, RestartRequired: restartRequired}
+		default:
+		}
+		if len(update.Changed) > 0 {
+			select {
+			case l.updates <- update:
+			default:
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// Updates returns the channel on which Reload publishes ConfigUpdates. Subsystems
+// that can apply a change live should watch it directly; anything that can't
+// should treat a RestartRequired update as a request to restart the dataplane.
+func (l *Loader) Updates() <-chan ConfigUpdate {
+	return l.updates
+}
+
+// Watch makes l hot-reloading: it calls Reload itself whenever the file
+// source's file changes, and at least every datastorePollInterval if l has a
+// datastore source (or the file source's directory couldn't be watched),
+// publishing each resulting change on Updates(). It returns once the watch is
+// established; the watch itself runs in a background goroutine until stopCh
+// is closed. Load must have been called first.
+func (l *Loader) Watch(stopCh <-chan struct{}) error {
+	var fw *fsnotify.Watcher
+	fs, _ := l.file.(*FileSource)
+	if fs != nil && fs.Path != "" {
+		var err error
+		fw, err = fsnotify.NewWatcher()
+		if err != nil {
+			return err
+		}
+		// Watch the containing directory rather than the file itself: an
+		// atomic rename-over (how Kubernetes ConfigMap mounts, and most
+		// "swap to a new config" deploy scripts, update a file) unlinks the
+		// inode fsnotify watched, so a watch on the file stops seeing events
+		// after the first swap. watchLoop filters back down to just this
+		// file by basename, the same trick policysync.AuthzWatcher uses.
+		//
+		// The directory may not exist yet (e.g. a ConfigMap volume that
+		// hasn't been mounted), matching FileSource.Load's own "missing path
+		// is just no overrides" tolerance: fall back to polling rather than
+		// failing Watch outright.
+		if err := fw.Add(filepath.Dir(fs.Path)); err != nil {
+			glog.Warningf("Can't watch %v for config changes, will only pick up changes to it on the poll interval: %v", fs.Path, err)
+			fw.Close()
+			fw = nil
+		}
+	}
+
+	go l.watchLoop(fw, fs, stopCh)
+	return nil
+}
+
+func (l *Loader) watchLoop(fw *fsnotify.Watcher, fs *FileSource, stopCh <-chan struct{}) {
+	if fw != nil {
+		defer fw.Close()
+	}
+
+	// Poll for datastore changes - and, if fw is nil, as a fallback for file
+	// changes too - but only if there's actually a datastore source or an
+	// unwatchable file to poll for; otherwise nothing would ever make the
+	// ticker's reloads find anything new.
+	var tickerC <-chan time.Time
+	if l.datastore != nil || (fs != nil && fw == nil) {
+		ticker := time.NewTicker(datastorePollInterval)
+		defer ticker.Stop()
+		tickerC = ticker.C
+	}
+
+	var events <-chan fsnotify.Event
+	var errors <-chan error
+	if fw != nil {
+		events = fw.Events
+		errors = fw.Errors
+	}
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if filepath.Base(event.Name) != filepath.Base(fs.Path) {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			if _, err := l.Reload(); err != nil {
+				glog.Warningf("Failed to reload config after %v changed: %v", fs.Path, err)
+			}
+		case err, ok := <-errors:
+			if !ok {
+				errors = nil
+				continue
+			}
+			glog.Warningf("Error watching config file: %v", err)
+		case <-tickerC:
+			if _, err := l.Reload(); err != nil {
+				glog.Warningf("Failed to poll datastore for config changes: %v", err)
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (l *Loader) resolve() (*Config, error) {
+	merged := make(map[string]string)
+	for _, m := range configMetadata {
+		if m.Default != "" {
+			merged[m.Name] = m.Default
+		}
+	}
+
+	// Precedence, lowest to highest: file, environment, datastore.
+	for _, src := range []Source{l.file, l.env, l.datastore} {
+		if src == nil {
+			continue
+		}
+		vals, err := src.Load()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load config from %v: %v", src.Name(), err)
+		}
+		for k, v := range vals {
+			merged[strings.ToLower(k)] = v
+		}
+	}
+
+	cfg := &Config{}
+	rv := reflect.ValueOf(cfg).Elem()
+	for _, m := range configMetadata {
+		raw, ok := merged[m.Name]
+		if !ok {
+			// No source (including the struct tag default) set this field;
+			// treat it the same as an explicit empty value for validation
+			// purposes, so e.g. validate=non-zero still rejects it instead
+			// of silently leaving the field at its Go zero value.
+			if err := validateValue(m, ""); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := validateValue(m, raw); err != nil {
+			return nil, err
+		}
+		if err := setField(rv.Field(m.FieldIndex), raw); err != nil {
+			return nil, fmt.Errorf("failed to parse %v=%q: %v", m.Name, raw, err)
+		}
+	}
+	return cfg, nil
+}
+
+func diffConfig(old, new *Config) (changed []string, restartRequired bool) {
+	if old == nil {
+		return nil, false
+	}
+	ov := reflect.ValueOf(*old)
+	nv := reflect.ValueOf(*new)
+	for _, m := range configMetadata {
+		if !reflect.DeepEqual(ov.Field(m.FieldIndex).Interface(), nv.Field(m.FieldIndex).Interface()) {
+			changed = append(changed, m.Name)
+			if m.RestartRequired {
+				restartRequired = true
+			}
+		}
+	}
+	return changed, restartRequired
+}
+
+func validateValue(m fieldMetadata, raw string) error {
+	switch {
+	case m.Validate == "":
+		return nil
+	case m.Validate == "non-zero":
+		if raw == "" {
+			return fmt.Errorf("%v: value must not be empty", m.Name)
+		}
+	case strings.HasPrefix(m.Validate, "oneof(") && strings.HasSuffix(m.Validate, ")"):
+		opts := strings.Split(m.Validate[len("oneof(") : len(m.Validate)-1], ",")
+		for _, o := range opts {
+			if raw == o {
+				return nil
+			}
+		}
+		return fmt.Errorf("%v: %q is not one of %v", m.Name, raw, opts)
+	}
+	return nil
+}
+
+func setField(fv reflect.Value, raw string) error {
+	if fv.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		fv.Set(reflect.ValueOf(d))
+		return nil
+	}
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(n)
+	default:
+		return fmt.Errorf("unsupported config field kind %v", fv.Kind())
+	}
+	return nil
+}
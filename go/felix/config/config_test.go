@@ -0,0 +1,127 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import "testing"
+
+// fakeSource is a Source backed by a fixed map, for testing Loader's merge
+// precedence without touching the filesystem, environment, or a datastore.
+type fakeSource struct {
+	name string
+	vals map[string]string
+}
+
+func (s *fakeSource) Name() string { return s.name }
+
+func (s *fakeSource) Load() (map[string]string, error) {
+	return s.vals, nil
+}
+
+func TestResolvePrecedence(t *testing.T) {
+	file := &fakeSource{name: "file", vals: map[string]string{
+		"felixhostname": "from-file",
+		"etcdaddr":      "file-addr:2379",
+	}}
+	env := &fakeSource{name: "env", vals: map[string]string{
+		"etcdaddr": "env-addr:2379",
+	}}
+	datastore := &fakeSource{name: "datastore", vals: map[string]string{
+		"etcdaddr": "datastore-addr:2379",
+	}}
+
+	l := NewLoader(file, env, datastore)
+	cfg, err := l.Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	if cfg.FelixHostname != "from-file" {
+		t.Errorf("FelixHostname = %q, want %q (only file set it)", cfg.FelixHostname, "from-file")
+	}
+	if cfg.EtcdAddr != "datastore-addr:2379" {
+		t.Errorf("EtcdAddr = %q, want the datastore value to win over env and file", cfg.EtcdAddr)
+	}
+	if cfg.DatastoreType != "etcdv2" {
+		t.Errorf("DatastoreType = %q, want the struct tag default since no source sets it", cfg.DatastoreType)
+	}
+}
+
+func TestResolveNonZeroValidatorRejectsAbsentField(t *testing.T) {
+	// Nothing sets FelixHostname, and its default is the empty string, so
+	// validate=non-zero must reject it rather than silently resolving "".
+	l := NewLoader(nil, nil, nil)
+	_, err := l.Load()
+	if err == nil {
+		t.Fatal("Load succeeded, want an error because FelixHostname is required and unset")
+	}
+}
+
+func TestResolveOneofValidatorRejectsBadValue(t *testing.T) {
+	file := &fakeSource{name: "file", vals: map[string]string{
+		"felixhostname": "host-1",
+		"datastoretype": "bogus",
+	}}
+	l := NewLoader(file, nil, nil)
+	_, err := l.Load()
+	if err == nil {
+		t.Fatal("Load succeeded, want an error because datastoretype isn't one of the allowed values")
+	}
+}
+
+func TestDiffConfigFlagsRestartRequired(t *testing.T) {
+	file := &fakeSource{name: "file", vals: map[string]string{"felixhostname": "host-1"}}
+	l := NewLoader(file, nil, nil)
+	if _, err := l.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	// ReportingIntervalSecs isn't tagged restart=true; FelixHostname is.
+	file.vals["reportingintervalsecs"] = "60"
+	cfg, err := l.Reload()
+	if err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if cfg.ReportingIntervalSecs != 60 {
+		t.Fatalf("ReportingIntervalSecs = %v, want 60", cfg.ReportingIntervalSecs)
+	}
+	select {
+	case update := <-l.Updates():
+		if len(update.Changed) != 1 || update.Changed[0] != "reportingintervalsecs" {
+			t.Errorf("Changed = %v, want just [reportingintervalsecs]", update.Changed)
+		}
+		if update.RestartRequired {
+			t.Error("RestartRequired = true, want false: reportingintervalsecs isn't tagged restart=true")
+		}
+	default:
+		t.Fatal("expected a ConfigUpdate on Updates(), got none")
+	}
+
+	file.vals["felixhostname"] = "host-2"
+	cfg, err = l.Reload()
+	if err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if cfg.FelixHostname != "host-2" {
+		t.Fatalf("FelixHostname = %q, want %q", cfg.FelixHostname, "host-2")
+	}
+	select {
+	case update := <-l.Updates():
+		if !update.RestartRequired {
+			t.Error("RestartRequired = false, want true: felixhostname is tagged restart=true")
+		}
+	default:
+		t.Fatal("expected a ConfigUpdate on Updates(), got none")
+	}
+}
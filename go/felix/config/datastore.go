@@ -0,0 +1,56 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import "strings"
+
+// DatastoreClient is the minimal surface this package needs in order to read
+// dynamic Felix config from the calico datastore. It is kept narrow so that
+// config doesn't have to import the full datastore client; an adapter over
+// libcalico-go's clientv3 FelixConfiguration client can implement it.
+type DatastoreClient interface {
+	GetFelixConfig() (map[string]string, error)
+}
+
+// DatastoreSource is a Source that reads Felix parameters out of the calico
+// datastore. It takes precedence over every other source, since it's the one
+// an operator can change live without touching a node.
+type DatastoreSource struct {
+	Client DatastoreClient
+}
+
+// NewDatastoreSource builds a DatastoreSource backed by client.
+func NewDatastoreSource(client DatastoreClient) *DatastoreSource {
+	return &DatastoreSource{Client: client}
+}
+
+func (s *DatastoreSource) Name() string {
+	return "datastore"
+}
+
+func (s *DatastoreSource) Load() (map[string]string, error) {
+	if s.Client == nil {
+		return map[string]string{}, nil
+	}
+	raw, err := s.Client.GetFelixConfig()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string, len(raw))
+	for k, v := range raw {
+		result[strings.ToLower(k)] = v
+	}
+	return result, nil
+}
@@ -15,10 +15,33 @@
 package config
 
 import (
-	"github.com/golang/glog"
+	"os"
 	"strings"
+
+	"github.com/golang/glog"
 )
 
+// EnvSource is a Source that reads FELIX_* environment variables, as set by
+// orchestrators that configure Felix via its container environment.
+type EnvSource struct {
+	Environ []string
+}
+
+// NewEnvSource builds an EnvSource from the process's own environment.
+func NewEnvSource() *EnvSource {
+	return &EnvSource{Environ: os.Environ()}
+}
+
+func (s *EnvSource) Name() string {
+	return "environment"
+}
+
+func (s *EnvSource) Load() (map[string]string, error) {
+	return LoadConfigFromEnvironment(s.Environ), nil
+}
+
+// LoadConfigFromEnvironment is kept for callers that haven't migrated to
+// Loader/EnvSource yet; EnvSource.Load delegates to it.
 func LoadConfigFromEnvironment(environ []string) map[string]string {
 	result := make(map[string]string)
 	for _, kv := range environ {
@@ -0,0 +1,77 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"gopkg.in/yaml.v2"
+)
+
+// FileSource is a Source that reads Felix parameters from a YAML or JSON file,
+// selected by extension (.yaml/.yml vs anything else). A missing path, or a
+// path that doesn't exist on disk, is treated as "no overrides" rather than an
+// error, since the file is optional.
+type FileSource struct {
+	Path string
+}
+
+// NewFileSource builds a FileSource from the FELIX_CONFIG_FILE environment
+// variable.
+func NewFileSource() *FileSource {
+	return &FileSource{Path: os.Getenv("FELIX_CONFIG_FILE")}
+}
+
+func (s *FileSource) Name() string {
+	return "file"
+}
+
+func (s *FileSource) Load() (map[string]string, error) {
+	if s.Path == "" {
+		return map[string]string{}, nil
+	}
+
+	data, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			glog.V(2).Infof("Config file %v does not exist, ignoring", s.Path)
+			return map[string]string{}, nil
+		}
+		return nil, err
+	}
+
+	raw := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(s.Path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	default:
+		err = json.Unmarshal(data, &raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %v: %v", s.Path, err)
+	}
+
+	result := make(map[string]string, len(raw))
+	for k, v := range raw {
+		result[strings.ToLower(k)] = fmt.Sprintf("%v", v)
+	}
+	return result, nil
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policysync
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// AllowRule grants a peer-UID (from SO_PEERCRED on the accepted management
+// socket connection) permission to act on workloads whose attributes match
+// all of the given globs. An empty glob matches anything.
+type AllowRule struct {
+	PeerUID          int    `json:"peer_uid"`
+	NamespaceGlob    string `json:"namespace"`
+	UIDGlob          string `json:"uid_glob"`
+	WorkloadpathGlob string `json:"workloadpath_glob"`
+}
+
+func (r AllowRule) matches(peerUID int, attrs WorkloadAttrs) bool {
+	if r.PeerUID != peerUID {
+		return false
+	}
+	return globMatches(r.NamespaceGlob, attrs.Namespace) &&
+		globMatches(r.UIDGlob, attrs.Uid) &&
+		globMatches(r.WorkloadpathGlob, attrs.Workloadpath)
+}
+
+func globMatches(glob, value string) bool {
+	if glob == "" {
+		return true
+	}
+	ok, err := path.Match(glob, value)
+	return err == nil && ok
+}
+
+// Policy is a compiled management-socket authorization policy: a request is
+// allowed if any rule matches.
+type Policy struct {
+	Rules []AllowRule `json:"rules"`
+}
+
+// Allowed reports whether peerUID may act on a workload with attrs.
+func (p *Policy) Allowed(peerUID int, attrs WorkloadAttrs) bool {
+	if p == nil {
+		// No policy file configured: authorization isn't enabled.
+		return true
+	}
+	for _, r := range p.Rules {
+		if r.matches(peerUID, attrs) {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthzWatcher holds the current management-socket authorization Policy,
+// loaded from a JSON file and atomically swapped in place whenever the file
+// changes, so Felix never has to restart to pick up a new policy.
+type AuthzWatcher struct {
+	path    string
+	current atomic.Value // *Policy
+	watcher *fsnotify.Watcher
+}
+
+// NewAuthzWatcher loads the policy at path and starts watching it for
+// changes. An empty path disables authorization: Current().Allowed always
+// returns true.
+func NewAuthzWatcher(path string) (*AuthzWatcher, error) {
+	w := &AuthzWatcher{path: path}
+	if path == "" {
+		w.current.Store((*Policy)(nil))
+		return w, nil
+	}
+
+	if err := w.reload(); err != nil {
+		return nil, err
+	}
+
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// Watch the containing directory rather than path itself: an atomic
+	// rename-over (how Kubernetes ConfigMap mounts, and most "swap to a new
+	// policy" deploy scripts, update a file) unlinks the inode fsnotify
+	// watched, so a watch on path stops seeing events after the first swap.
+	// watchLoop filters events back down to just this file by basename.
+	if err := fw.Add(filepath.Dir(path)); err != nil {
+		fw.Close()
+		return nil, err
+	}
+	w.watcher = fw
+	go w.watchLoop()
+	return w, nil
+}
+
+// Current returns the most recently loaded Policy.
+func (w *AuthzWatcher) Current() *Policy {
+	return w.current.Load().(*Policy)
+}
+
+// Close stops the background file watch.
+func (w *AuthzWatcher) Close() error {
+	if w.watcher == nil {
+		return nil
+	}
+	return w.watcher.Close()
+}
+
+func (w *AuthzWatcher) watchLoop() {
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Base(event.Name) != filepath.Base(w.path) {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			if err := w.reload(); err != nil {
+				log.WithError(err).WithField("path", w.path).Warn("Failed to reload management-socket authz policy, keeping previous policy")
+			} else {
+				log.WithField("path", w.path).Info("Reloaded management-socket authz policy")
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.WithError(err).Warn("Error watching management-socket authz policy file")
+		}
+	}
+}
+
+func (w *AuthzWatcher) reload() error {
+	data, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		return err
+	}
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	w.current.Store(&p)
+	return nil
+}
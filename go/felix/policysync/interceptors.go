@@ -0,0 +1,117 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policysync
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+// workloadIDUnaryInterceptor stashes workloadID into the handler's context so
+// that proto.WorkloadIDFromContext - used by the recovery and observability
+// interceptors below, and by any handler that wants to log it - can recover
+// it. It must be chained ahead of those interceptors.
+func workloadIDUnaryInterceptor(workloadID string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(proto.ContextWithWorkloadID(ctx, workloadID), req)
+	}
+}
+
+// workloadIDStreamInterceptor is the streaming equivalent of
+// workloadIDUnaryInterceptor: it wraps ss so that ss.Context() carries
+// workloadID for the rest of the chain and the handler itself.
+func workloadIDStreamInterceptor(workloadID string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &workloadIDServerStream{ServerStream: ss, ctx: proto.ContextWithWorkloadID(ss.Context(), workloadID)})
+	}
+}
+
+// workloadIDServerStream overrides grpc.ServerStream.Context so a
+// workload-ID-carrying context propagates to every later interceptor and the
+// handler itself.
+type workloadIDServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *workloadIDServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// recoveryUnaryInterceptor turns a panic in a unary handler into a
+// codes.Internal error instead of letting it take down the whole Felix
+// process (and every other workload's stream along with it).
+func recoveryUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		defer recoverToError(info.FullMethod, proto.WorkloadIDFromContext(ctx), &err)
+		return handler(ctx, req)
+	}
+}
+
+// recoveryStreamInterceptor is the streaming equivalent of
+// recoveryUnaryInterceptor.
+func recoveryStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		defer recoverToError(info.FullMethod, proto.WorkloadIDFromContext(ss.Context()), &err)
+		return handler(srv, ss)
+	}
+}
+
+// recoverToError recovers a panic, if one is in flight, logs it with the
+// workload/RPC that triggered it, and sets *err to a codes.Internal status so
+// the caller's deferred recover()/return sees a normal gRPC error rather than
+// propagating the panic.
+func recoverToError(rpc, workloadID string, err *error) {
+	if r := recover(); r != nil {
+		log.WithFields(log.Fields{
+			"rpc":      rpc,
+			"workload": workloadID,
+			"panic":    r,
+		}).Error("Recovered from panic in PolicySync handler")
+		*err = status.Errorf(codes.Internal, "internal error handling %v", rpc)
+	}
+}
+
+// observabilityUnaryInterceptor records a request count and handler duration,
+// keyed by workload+RPC, for every unary call.
+func observabilityUnaryInterceptor(m *metrics) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		m.recordRequest(proto.WorkloadIDFromContext(ctx), info.FullMethod, time.Since(start))
+		return resp, err
+	}
+}
+
+// observabilityStreamInterceptor tracks open-stream counts and per-call
+// duration for streaming RPCs, keyed by workload+RPC.
+func observabilityStreamInterceptor(m *metrics) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		workloadID := proto.WorkloadIDFromContext(ss.Context())
+		start := time.Now()
+		m.streamOpened(workloadID, info.FullMethod)
+		defer m.streamClosed(workloadID, info.FullMethod)
+		err := handler(srv, ss)
+		m.recordRequest(workloadID, info.FullMethod, time.Since(start))
+		return err
+	}
+}
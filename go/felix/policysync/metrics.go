@@ -0,0 +1,87 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policysync
+
+import (
+	"sync"
+	"time"
+)
+
+// rpcKey identifies one (workload, RPC) pair for metrics purposes.
+type rpcKey struct {
+	workloadID string
+	rpc        string
+}
+
+// rpcStats is the bucket of counters tracked per rpcKey.
+type rpcStats struct {
+	requests     uint64
+	streamsOpen  int64
+	totalHandler time.Duration
+}
+
+// metrics is a process-wide, mutex-protected counter set keyed by
+// workload+RPC. It exists so the interceptors added in this package have
+// somewhere to record observability data without pulling in a metrics client
+// library that isn't otherwise a dependency of this tree.
+type metrics struct {
+	mu    sync.Mutex
+	stats map[rpcKey]*rpcStats
+}
+
+func newMetrics() *metrics {
+	return &metrics{stats: map[rpcKey]*rpcStats{}}
+}
+
+func (m *metrics) recordRequest(workloadID, rpc string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.bucketLocked(workloadID, rpc)
+	s.requests++
+	s.totalHandler += d
+}
+
+func (m *metrics) streamOpened(workloadID, rpc string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bucketLocked(workloadID, rpc).streamsOpen++
+}
+
+func (m *metrics) streamClosed(workloadID, rpc string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bucketLocked(workloadID, rpc).streamsOpen--
+}
+
+func (m *metrics) bucketLocked(workloadID, rpc string) *rpcStats {
+	key := rpcKey{workloadID: workloadID, rpc: rpc}
+	s, ok := m.stats[key]
+	if !ok {
+		s = &rpcStats{}
+		m.stats[key] = s
+	}
+	return s
+}
+
+// Snapshot returns a copy of the current counters, for tests and diagnostics.
+func (m *metrics) Snapshot() map[rpcKey]rpcStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make(map[rpcKey]rpcStats, len(m.stats))
+	for k, v := range m.stats {
+		out[k] = *v
+	}
+	return out
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policysync
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// WorkloadAttrs identifies a workload for management-socket operations and
+// for matching against the management-socket authorization policy.
+type WorkloadAttrs struct {
+	Namespace    string
+	Uid          string
+	Workloadpath string
+}
+
+// WorkloadInfo is what a node agent sends to WorkloadAdded/WorkloadRemoved.
+type WorkloadInfo struct {
+	Attrs WorkloadAttrs
+}
+
+// ManagementServer implements the policy-sync management socket: it lets a
+// node agent tell Felix when a workload appears or disappears, and hands back
+// the bearer token that workload's Sync RPC must present.
+type ManagementServer struct {
+	processor *Processor
+	authz     *AuthzWatcher
+}
+
+// NewManagementServer creates a ManagementServer backed by p's workload state.
+// authz is consulted on every WorkloadAdded/WorkloadRemoved call; pass one
+// built from an empty path (or nil) to leave authorization disabled.
+func NewManagementServer(p *Processor, authz *AuthzWatcher) *ManagementServer {
+	return &ManagementServer{processor: p, authz: authz}
+}
+
+// WorkloadAdded registers info's workload and returns a freshly generated
+// bearer token that its Sync RPC must present. Calling it again for a
+// workload that's already registered rotates the token, invalidating
+// whichever one was issued before. peerUID, read via SO_PEERCRED off the
+// management socket connection, must be allowed by the authz policy to act on
+// info's namespace/uid/workloadpath, or this returns codes.PermissionDenied.
+func (m *ManagementServer) WorkloadAdded(peerUID int, info WorkloadInfo) (token string, err error) {
+	if !m.allowed(peerUID, info.Attrs) {
+		return "", status.Errorf(codes.PermissionDenied, "peer uid %d is not authorized to manage workload %v", peerUID, info.Attrs)
+	}
+
+	token, err = generateToken()
+	if err != nil {
+		return "", err
+	}
+	ws := m.processor.workloadStateFor(info.Attrs.Uid)
+	ws.mu.Lock()
+	ws.token = token
+	ws.mu.Unlock()
+	return token, nil
+}
+
+func (m *ManagementServer) allowed(peerUID int, attrs WorkloadAttrs) bool {
+	if m.authz == nil {
+		return true
+	}
+	return m.authz.Current().Allowed(peerUID, attrs)
+}
+
+// WorkloadRemoved invalidates workloadID's token, so any Sync attempted
+// afterwards is rejected with codes.Unauthenticated; a Sync that already
+// started is not interrupted, since the token is only checked when a Sync
+// starts. A later WorkloadAdded for the same workload issues a fresh token. peerUID must be allowed by the authz policy to act on attrs,
+// the same check WorkloadAdded makes, or this returns codes.PermissionDenied
+// and leaves the current token untouched - otherwise any peer that can reach
+// the management socket could invalidate another, authorized workload's
+// token regardless of what the authz policy says.
+func (m *ManagementServer) WorkloadRemoved(peerUID int, attrs WorkloadAttrs) error {
+	if !m.allowed(peerUID, attrs) {
+		return status.Errorf(codes.PermissionDenied, "peer uid %d is not authorized to manage workload %v", peerUID, attrs)
+	}
+
+	ws := m.processor.workloadStateFor(attrs.Uid)
+	ws.mu.Lock()
+	ws.token = ""
+	ws.mu.Unlock()
+	return nil
+}
+
+// generateToken returns a random 32-byte bearer token, URL-safe encoded.
+func generateToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate workload token: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package policysync
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+// NewGRPCServer builds the *grpc.Server that serves m over the management
+// socket (see Listen). It authenticates every RPC's caller via SO_PEERCRED,
+// the same mechanism WorkloadAdded's peerUID parameter documents, so callers
+// of this constructor don't have to read peer credentials themselves.
+func (m *ManagementServer) NewGRPCServer() *grpc.Server {
+	// The hand-rolled message types in proto don't implement proto.Message, so
+	// they can't go through grpc-go's default codec; see proto.gobCodec.
+	s := grpc.NewServer(grpc.Creds(peerCredCredentials{}), grpc.ForceServerCodec(proto.GobCodec()))
+	proto.RegisterManagementServer(s, &grpcManagementServer{m: m})
+	return s
+}
+
+// grpcManagementServer adapts ManagementServer's Go API, which takes an
+// already-resolved peer UID, onto proto.ManagementServer, which recovers that
+// UID from the peerCredCredentials AuthInfo NewGRPCServer installs.
+type grpcManagementServer struct {
+	m *ManagementServer
+}
+
+func (g *grpcManagementServer) WorkloadAdded(ctx context.Context, req *proto.WorkloadAddedRequest) (*proto.WorkloadAddedResponse, error) {
+	peerUID, err := peerUIDFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "%v", err)
+	}
+	token, err := g.m.WorkloadAdded(peerUID, WorkloadInfo{Attrs: WorkloadAttrs{
+		Namespace:    req.Namespace,
+		Uid:          req.Uid,
+		Workloadpath: req.Workloadpath,
+	}})
+	if err != nil {
+		return nil, err
+	}
+	return &proto.WorkloadAddedResponse{Token: token}, nil
+}
+
+func (g *grpcManagementServer) WorkloadRemoved(ctx context.Context, req *proto.WorkloadRemovedRequest) (*proto.WorkloadRemovedResponse, error) {
+	peerUID, err := peerUIDFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "%v", err)
+	}
+	if err := g.m.WorkloadRemoved(peerUID, WorkloadAttrs{
+		Namespace:    req.Namespace,
+		Uid:          req.Uid,
+		Workloadpath: req.Workloadpath,
+	}); err != nil {
+		return nil, err
+	}
+	return &proto.WorkloadRemovedResponse{}, nil
+}
+
+func peerUIDFromContext(ctx context.Context) (int, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return 0, fmt.Errorf("no peer credentials on management socket connection")
+	}
+	info, ok := p.AuthInfo.(peerUIDAuthInfo)
+	if !ok {
+		return 0, fmt.Errorf("management socket connection was not authenticated via SO_PEERCRED")
+	}
+	return info.uid, nil
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package policysync
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// PeerUID returns the UID of the process on the other end of conn, via
+// SO_PEERCRED. conn must be a *net.UnixConn, which is always true for
+// connections accepted off a policysync.Listen socket.
+func PeerUID(conn net.Conn) (int, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, fmt.Errorf("connection is not a Unix domain socket: %T", conn)
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, credErr
+	}
+	return int(cred.Uid), nil
+}
+
+// peerUIDAuthInfo carries the SO_PEERCRED-derived UID of a management-socket
+// connection through a *grpc.Server's credentials.AuthInfo, so a handler can
+// recover it via peer.FromContext without threading a net.Conn through the
+// RPC layer itself.
+type peerUIDAuthInfo struct {
+	uid int
+}
+
+func (peerUIDAuthInfo) AuthType() string { return "peercred" }
+
+// peerCredCredentials is a credentials.TransportCredentials that performs no
+// actual handshake: it just reads SO_PEERCRED off the accepted connection and
+// stashes the result as AuthInfo, so grpc.Creds(peerCredCredentials{}) is
+// enough to make every RPC's context carry its caller's UID.
+type peerCredCredentials struct{}
+
+func (peerCredCredentials) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return conn, nil, nil
+}
+
+func (peerCredCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	uid, err := PeerUID(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, peerUIDAuthInfo{uid: uid}, nil
+}
+
+func (peerCredCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "peercred"}
+}
+
+func (c peerCredCredentials) Clone() credentials.TransportCredentials {
+	return c
+}
+
+func (peerCredCredentials) OverrideServerName(string) error {
+	return nil
+}
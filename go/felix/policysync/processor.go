@@ -0,0 +1,340 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package policysync implements Felix's PolicySync API: a gRPC service,
+// exposed over a per-workload Unix domain socket, that streams each
+// workload's policy/endpoint/IP-set state to its dataplane driver.
+package policysync
+
+import (
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/projectcalico/felix/config"
+	"github.com/projectcalico/felix/proto"
+)
+
+// sendQueueDepth bounds the number of outstanding updates queued for a
+// workload's stream. It exists so a slow consumer can't block the
+// calculation graph that calls Publish; see Processor.Publish.
+const sendQueueDepth = 64
+
+// FullSyncer sends a complete snapshot of workloadID's state down stream,
+// followed by an InSync marker. It's called whenever a stream can't be
+// resumed from the ring buffer - no resume token, a Felix restart since the
+// token was issued, or the token aged out of the buffer. The real
+// implementation lives in Felix's calculation graph.
+type FullSyncer func(workloadID string, stream proto.PolicySync_SyncServer) error
+
+// Processor computes per-workload policy state and serves it over the
+// PolicySync API. NewGRPCServer builds a *grpc.Server for each workload
+// socket, all with the same base interceptor chain; the Processor doesn't
+// keep hold of the servers it builds.
+type Processor struct {
+	// ExtraServerOptions are appended after this package's own interceptor
+	// chain when building each workload's *grpc.Server, so that downstream
+	// builds can add their own auth/metrics interceptors without forking
+	// this package.
+	ExtraServerOptions []grpc.ServerOption
+
+	// FullSync is invoked whenever a workload stream can't be resumed; see
+	// FullSyncer.
+	FullSync FullSyncer
+
+	resumeBufferSize int
+	maxMessageBytes  int
+	metrics          *metrics
+
+	mu        sync.Mutex
+	workloads map[string]*workloadState
+}
+
+// workloadState is the resume buffer and currently-attached stream (if any)
+// for one workload. It outlives any single Sync call so a later reconnect can
+// still resume from it.
+type workloadState struct {
+	mu     sync.Mutex
+	buf    *resumeBuffer
+	stream proto.PolicySync_SyncServer
+	// outCh is the bounded queue Publish enqueues onto and the current
+	// stream's send loop drains; nil when no stream is attached.
+	outCh chan *proto.ToDataplane
+	// desynced is set when outCh overflowed while a stream was attached,
+	// meaning that stream missed at least one update. The next Sync for this
+	// workload ignores any resume token and forces a full resync.
+	desynced bool
+	seq      uint64
+	// token is the bearer token handed out by the last WorkloadAdded call for
+	// this workload (see mgmt.go); empty means no workload is currently
+	// registered and every Sync is rejected.
+	token string
+}
+
+// NewProcessor creates a Processor ready to build workload gRPC servers.
+// cfg.PolicySyncResumeBufferSize controls how many recent deltas are kept per
+// workload for resume purposes, and cfg.PolicySyncMaxMessageBytes is the
+// largest single marshaled update Felix will send before chunking it.
+func NewProcessor(cfg *config.Config) *Processor {
+	return &Processor{
+		resumeBufferSize: cfg.PolicySyncResumeBufferSize,
+		maxMessageBytes:  cfg.PolicySyncMaxMessageBytes,
+		metrics:          newMetrics(),
+		workloads:        map[string]*workloadState{},
+	}
+}
+
+// NewGRPCServer builds a *grpc.Server for workloadID's PolicySync socket,
+// wired with a workload-ID-injecting interceptor ahead of the panic-recovery
+// and observability interceptors (so both see a context that already carries
+// workloadID via proto.WorkloadIDFromContext), then p.ExtraServerOptions, and
+// with srv registered as the PolicySync handler.
+func (p *Processor) NewGRPCServer(workloadID string, srv proto.PolicySyncServer) *grpc.Server {
+	opts := []grpc.ServerOption{
+		// The hand-rolled message types in proto don't implement proto.Message,
+		// so they can't go through grpc-go's default codec; see proto.gobCodec.
+		grpc.ForceServerCodec(proto.GobCodec()),
+		grpc.ChainUnaryInterceptor(
+			workloadIDUnaryInterceptor(workloadID),
+			recoveryUnaryInterceptor(),
+			observabilityUnaryInterceptor(p.metrics),
+		),
+		grpc.ChainStreamInterceptor(
+			workloadIDStreamInterceptor(workloadID),
+			recoveryStreamInterceptor(),
+			observabilityStreamInterceptor(p.metrics),
+		),
+	}
+	opts = append(opts, p.ExtraServerOptions...)
+
+	s := grpc.NewServer(opts...)
+	proto.RegisterPolicySyncServer(s, srv)
+	return s
+}
+
+// WorkloadHandler returns a proto.PolicySyncServer that serves workloadID's
+// Sync RPC, resuming from the ring buffer when the client presents a valid
+// resume token and falling back to p.FullSync otherwise. Pass the same
+// workloadID to NewGRPCServer so the interceptor chain can tag logs and
+// metrics with it.
+func (p *Processor) WorkloadHandler(workloadID string) proto.PolicySyncServer {
+	return &workloadHandler{processor: p, workloadID: workloadID}
+}
+
+type workloadHandler struct {
+	processor  *Processor
+	workloadID string
+}
+
+func (h *workloadHandler) Sync(req *proto.SyncRequest, stream proto.PolicySync_SyncServer) error {
+	return h.processor.sync(h.workloadID, req, stream)
+}
+
+func (p *Processor) sync(workloadID string, req *proto.SyncRequest, stream proto.PolicySync_SyncServer) error {
+	ws := p.workloadStateFor(workloadID)
+
+	ws.mu.Lock()
+	expectedToken := ws.token
+	ws.mu.Unlock()
+	if expectedToken == "" || req.Token != expectedToken {
+		return status.Errorf(codes.Unauthenticated, "missing or invalid token for workload %v", workloadID)
+	}
+
+	outCh := make(chan *proto.ToDataplane, sendQueueDepth)
+	quit := make(chan struct{})
+	ws.mu.Lock()
+	ws.stream = stream
+	ws.outCh = outCh
+	ws.mu.Unlock()
+	defer func() {
+		ws.mu.Lock()
+		if ws.stream == stream {
+			ws.stream = nil
+			ws.outCh = nil
+		}
+		ws.mu.Unlock()
+		close(quit)
+	}()
+
+	// Do the resume-or-full-sync handshake before the send loop starts, so
+	// this goroutine is the only one calling stream.Send while it's running:
+	// tryResume and FullSync both write to stream directly, and grpc-go
+	// doesn't allow concurrent Send calls on one stream. Publish may still be
+	// enqueuing onto outCh concurrently during the handshake - that's fine,
+	// since nothing drains outCh (and so nothing calls stream.Send for it)
+	// until runSendLoop starts below.
+	resumed, err := p.tryResume(ws, req, stream)
+	if err != nil {
+		return err
+	}
+	if !resumed {
+		if p.FullSync == nil {
+			return status.Errorf(codes.Unimplemented, "no full-sync source configured for %v", workloadID)
+		}
+		if err := p.FullSync(workloadID, stream); err != nil {
+			return err
+		}
+		ws.mu.Lock()
+		ws.desynced = false
+		ws.mu.Unlock()
+	}
+
+	sendLoopDone := make(chan error, 1)
+	go func() { sendLoopDone <- p.runSendLoop(stream, outCh, quit) }()
+
+	select {
+	case <-stream.Context().Done():
+		return stream.Context().Err()
+	case err := <-sendLoopDone:
+		return err
+	}
+}
+
+// runSendLoop drains outCh onto stream until quit is closed (the Sync call
+// that owns it returning) or a Send fails. It never closes outCh itself,
+// since Publish may still be writing to it concurrently from another
+// workload update right up until the Sync call tears it down.
+func (p *Processor) runSendLoop(stream proto.PolicySync_SyncServer, outCh <-chan *proto.ToDataplane, quit <-chan struct{}) error {
+	for {
+		select {
+		case msg := <-outCh:
+			if err := p.sendMsg(stream, msg); err != nil {
+				return err
+			}
+		case <-quit:
+			return nil
+		}
+	}
+}
+
+// tryResume attempts to satisfy req.Resume from ws.buf. It returns (true, nil)
+// if the client is now caught up and doesn't need a full sync; (false, nil) if
+// a ResumeRejected was sent (or no resume was requested) and the caller should
+// fall back to FullSync; and a non-nil error only if sending on stream failed.
+func (p *Processor) tryResume(ws *workloadState, req *proto.SyncRequest, stream proto.PolicySync_SyncServer) (bool, error) {
+	if req.Resume == nil {
+		return false, nil
+	}
+
+	ws.mu.Lock()
+	desynced := ws.desynced
+	ws.mu.Unlock()
+	if desynced {
+		return false, p.sendResumeRejected(stream, "stream was desynced after a slow-consumer overflow")
+	}
+	if req.Resume.BootID != bootID {
+		return false, p.sendResumeRejected(stream, "felix has restarted since the last connection")
+	}
+
+	ws.mu.Lock()
+	deltas, ok := ws.buf.Since(req.Resume.Seq)
+	ws.mu.Unlock()
+	if !ok {
+		return false, p.sendResumeRejected(stream, "resume point is no longer in the buffer")
+	}
+
+	for _, d := range deltas {
+		if err := p.sendMsg(stream, d); err != nil {
+			return false, err
+		}
+	}
+	if err := p.sendMsg(stream, &proto.ToDataplane{BootID: bootID, Payload: &proto.InSync{}}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (p *Processor) sendResumeRejected(stream proto.PolicySync_SyncServer, reason string) error {
+	return p.sendMsg(stream, &proto.ToDataplane{BootID: bootID, Payload: &proto.ResumeRejected{Reason: reason}})
+}
+
+// sendMsg sends msg on stream, transparently splitting it into
+// ChunkBegin/Chunk/ChunkEnd frames if its marshaled payload exceeds
+// p.maxMessageBytes, so a single outsized policy/endpoint update can't
+// silently break on gRPC's default max-message-size limit.
+func (p *Processor) sendMsg(stream proto.PolicySync_SyncServer, msg *proto.ToDataplane) error {
+	data, err := proto.MarshalPayload(msg.Payload)
+	if err != nil {
+		return err
+	}
+	if p.maxMessageBytes <= 0 || len(data) <= p.maxMessageBytes {
+		return stream.Send(msg)
+	}
+
+	txnID := fmt.Sprintf("%s-%d", msg.BootID, msg.SeqNo)
+	if err := stream.Send(&proto.ToDataplane{BootID: msg.BootID, SeqNo: msg.SeqNo, Payload: &proto.ChunkBegin{TxnID: txnID, TotalBytes: len(data)}}); err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		n := p.maxMessageBytes
+		if n > len(data) {
+			n = len(data)
+		}
+		chunk := &proto.Chunk{TxnID: txnID, Data: data[:n]}
+		data = data[n:]
+		if err := stream.Send(&proto.ToDataplane{BootID: msg.BootID, SeqNo: msg.SeqNo, Payload: chunk}); err != nil {
+			return err
+		}
+	}
+	return stream.Send(&proto.ToDataplane{BootID: msg.BootID, SeqNo: msg.SeqNo, Payload: &proto.ChunkEnd{TxnID: txnID}})
+}
+
+// Publish stamps payload with the next Seq for workloadID, records it in that
+// workload's resume buffer, and enqueues it for the workload's stream if one
+// is currently attached. It never blocks: if the stream's send queue is full,
+// the stream is marked desynced (forcing a full resync on its next Sync)
+// rather than stalling the caller, which is normally Felix's calculation
+// graph.
+func (p *Processor) Publish(workloadID string, payload interface{}) error {
+	ws := p.workloadStateFor(workloadID)
+
+	ws.mu.Lock()
+	ws.seq++
+	msg := &proto.ToDataplane{BootID: bootID, SeqNo: ws.seq, Payload: payload}
+	ws.buf.Append(msg)
+	outCh := ws.outCh
+	ws.mu.Unlock()
+
+	if outCh == nil {
+		// No stream currently attached; the ring buffer still has it for
+		// whenever one connects or resumes.
+		return nil
+	}
+
+	select {
+	case outCh <- msg:
+		return nil
+	default:
+		ws.mu.Lock()
+		ws.desynced = true
+		ws.mu.Unlock()
+		log.WithField("workload", workloadID).Warn("PolicySync send queue full, marking stream desynced")
+		return nil
+	}
+}
+
+func (p *Processor) workloadStateFor(workloadID string) *workloadState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ws, ok := p.workloads[workloadID]
+	if !ok {
+		ws = &workloadState{buf: newResumeBuffer(p.resumeBufferSize)}
+		p.workloads[workloadID] = ws
+	}
+	return ws
+}
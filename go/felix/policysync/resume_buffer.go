@@ -0,0 +1,61 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policysync
+
+import "github.com/projectcalico/felix/proto"
+
+// resumeBuffer is a fixed-size ring of the most recent ToDataplane messages
+// sent to one workload, indexed by SeqNo, so a reconnecting client can
+// resume from wherever it left off instead of forcing a full resync.
+type resumeBuffer struct {
+	entries []*proto.ToDataplane
+	size    int
+}
+
+func newResumeBuffer(size int) *resumeBuffer {
+	if size <= 0 {
+		size = 1
+	}
+	return &resumeBuffer{size: size}
+}
+
+// Append records msg as the newest entry, evicting the oldest once the buffer
+// is full.
+func (b *resumeBuffer) Append(msg *proto.ToDataplane) {
+	b.entries = append(b.entries, msg)
+	if len(b.entries) > b.size {
+		b.entries = b.entries[len(b.entries)-b.size:]
+	}
+}
+
+// Since returns every buffered message with SeqNo > seq, in order. The second
+// return value is false if seq is older than anything left in the buffer (or
+// the buffer has wrapped past it), meaning the caller must fall back to a
+// full resync instead.
+func (b *resumeBuffer) Since(seq uint64) ([]*proto.ToDataplane, bool) {
+	if seq == 0 {
+		return nil, len(b.entries) == 0
+	}
+	if len(b.entries) == 0 || seq < b.entries[0].SeqNo-1 {
+		return nil, false
+	}
+	var out []*proto.ToDataplane
+	for _, e := range b.entries {
+		if e.SeqNo > seq {
+			out = append(out, e)
+		}
+	}
+	return out, true
+}
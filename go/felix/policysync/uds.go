@@ -0,0 +1,43 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policysync
+
+import (
+	"net"
+	"strings"
+)
+
+// Listen opens the Unix domain socket listener for path, which may be either
+// a regular filesystem path or a Linux abstract-namespace socket, spelled as
+// either a leading "@" or the "unix-abstract:" prefix gRPC's own dial targets
+// use. Abstract sockets touch no filesystem entry and are cleaned up by the
+// kernel as soon as the last fd referencing them closes, which avoids the
+// bind-mount/chmod dance a plain path needs when the listener and its dialers
+// are in different mount namespaces (as felix and a workload's CNI plugin
+// typically are).
+func Listen(path string) (net.Listener, error) {
+	return net.Listen("unix", AbstractSocketName(path))
+}
+
+// AbstractSocketName normalizes path to whatever net.Listen/net.Dial expect: a
+// leading "@" for an abstract socket, or the path unchanged. It's exported so
+// dialers (e.g. a workload's gRPC.WithDialer callback) can recognize the same
+// "@"/"unix-abstract:" syntax Listen does.
+func AbstractSocketName(path string) string {
+	if name := strings.TrimPrefix(path, "unix-abstract:"); name != path {
+		return "@" + name
+	}
+	return path
+}
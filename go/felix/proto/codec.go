@@ -0,0 +1,95 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proto
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+
+	"google.golang.org/grpc/encoding"
+)
+
+// codecName is the content-subtype under which gobCodec is registered. None
+// of the message types in this package implement proto.Message, so grpc-go's
+// built-in "proto" codec can't marshal them; callers select gobCodec instead
+// of grpc-go's default via grpc.CallContentSubtype(codecName) on the client
+// side and grpc.ForceServerCodec(gobCodec{}) on the server side (see
+// policysync.Processor.NewGRPCServer, (*ManagementServer).NewGRPCServer, and
+// PolicySyncClient/ManagementClient).
+const codecName = "gob"
+
+func init() {
+	gob.Register(&InSync{})
+	gob.Register(&ResumeRejected{})
+	gob.Register(&WorkloadEndpointUpdate{})
+	gob.Register(&WorkloadEndpointRemove{})
+	gob.Register(&ChunkBegin{})
+	gob.Register(&Chunk{})
+	gob.Register(&ChunkEnd{})
+
+	encoding.RegisterCodec(gobCodec{})
+}
+
+// gobCodec is the encoding.Codec backing every RPC this package defines. It's
+// a thin wrapper around encoding/gob so that SyncRequest/ToDataplane/etc. -
+// and in particular ToDataplane.Payload, whose static type is interface{} -
+// round-trip without needing protoc-generated proto.Message implementations.
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return codecName }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, fmt.Errorf("failed to gob-encode %T: %w", v, err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(v); err != nil {
+		return fmt.Errorf("failed to gob-decode into %T: %w", v, err)
+	}
+	return nil
+}
+
+// GobCodec returns the encoding.Codec servers must pass to
+// grpc.ForceServerCodec so that every RPC on them uses gobCodec regardless of
+// what content-subtype (if any) the client requested.
+func GobCodec() encoding.Codec {
+	return gobCodec{}
+}
+
+// MarshalPayload encodes a ToDataplane.Payload to bytes, both to decide
+// whether it needs to be chunked (see ChunkBegin/Chunk/ChunkEnd) and as the
+// wire representation carried inside the resulting Chunk frames.
+func MarshalPayload(payload interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&payload); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalPayload decodes bytes produced by MarshalPayload back into a
+// payload value, for the client side of a reassembled chunked transfer.
+func UnmarshalPayload(data []byte) (interface{}, error) {
+	var payload interface{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proto
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+)
+
+// WorkloadAddedRequest is sent over Felix's policy-sync management socket
+// whenever a node agent learns about a new workload.
+type WorkloadAddedRequest struct {
+	Namespace    string
+	Uid          string
+	Workloadpath string
+}
+
+// WorkloadAddedResponse carries the bearer token the workload's dataplane
+// driver must present on its own Sync RPC (see SyncRequest.Token).
+type WorkloadAddedResponse struct {
+	Token string
+}
+
+// WorkloadRemovedRequest is sent when a node agent learns a workload is gone.
+// It carries the same attributes WorkloadAddedRequest did so the authz policy
+// can be consulted the same way on removal as it is on addition.
+type WorkloadRemovedRequest struct {
+	Namespace    string
+	Uid          string
+	Workloadpath string
+}
+
+// WorkloadRemovedResponse is currently empty; it exists so WorkloadRemoved has
+// the same (req, resp, error) shape as WorkloadAdded.
+type WorkloadRemovedResponse struct{}
+
+// ManagementServer is the interface Felix's policy-sync management socket
+// implements; RegisterManagementServer wires an implementation into a
+// *grpc.Server.
+type ManagementServer interface {
+	WorkloadAdded(context.Context, *WorkloadAddedRequest) (*WorkloadAddedResponse, error)
+	WorkloadRemoved(context.Context, *WorkloadRemovedRequest) (*WorkloadRemovedResponse, error)
+}
+
+var managementServiceDesc = grpc.ServiceDesc{
+	ServiceName: "felix.PolicySyncManagement",
+	HandlerType: (*ManagementServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "WorkloadAdded",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := new(WorkloadAddedRequest)
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				if interceptor == nil {
+					return srv.(ManagementServer).WorkloadAdded(ctx, req)
+				}
+				info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/felix.PolicySyncManagement/WorkloadAdded"}
+				handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(ManagementServer).WorkloadAdded(ctx, req.(*WorkloadAddedRequest))
+				}
+				return interceptor(ctx, req, info, handler)
+			},
+		},
+		{
+			MethodName: "WorkloadRemoved",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := new(WorkloadRemovedRequest)
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				if interceptor == nil {
+					return srv.(ManagementServer).WorkloadRemoved(ctx, req)
+				}
+				info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/felix.PolicySyncManagement/WorkloadRemoved"}
+				handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(ManagementServer).WorkloadRemoved(ctx, req.(*WorkloadRemovedRequest))
+				}
+				return interceptor(ctx, req, info, handler)
+			},
+		},
+	},
+	Metadata: "felix/proto/mgmt.proto",
+}
+
+// RegisterManagementServer registers srv as the handler for the
+// felix.PolicySyncManagement service on s.
+func RegisterManagementServer(s *grpc.Server, srv ManagementServer) {
+	s.RegisterService(&managementServiceDesc, srv)
+}
+
+// ManagementClient is the client-side stub for the felix.PolicySyncManagement
+// service, returned by NewManagementClient.
+type ManagementClient interface {
+	WorkloadAdded(ctx context.Context, in *WorkloadAddedRequest, opts ...grpc.CallOption) (*WorkloadAddedResponse, error)
+	WorkloadRemoved(ctx context.Context, in *WorkloadRemovedRequest, opts ...grpc.CallOption) (*WorkloadRemovedResponse, error)
+}
+
+type managementClient struct {
+	cc *grpc.ClientConn
+}
+
+// NewManagementClient wraps cc as a ManagementClient.
+func NewManagementClient(cc *grpc.ClientConn) ManagementClient {
+	return &managementClient{cc: cc}
+}
+
+func (c *managementClient) WorkloadAdded(ctx context.Context, in *WorkloadAddedRequest, opts ...grpc.CallOption) (*WorkloadAddedResponse, error) {
+	out := new(WorkloadAddedResponse)
+	opts = append(opts, grpc.CallContentSubtype(codecName))
+	if err := c.cc.Invoke(ctx, "/felix.PolicySyncManagement/WorkloadAdded", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managementClient) WorkloadRemoved(ctx context.Context, in *WorkloadRemovedRequest, opts ...grpc.CallOption) (*WorkloadRemovedResponse, error) {
+	out := new(WorkloadRemovedResponse)
+	opts = append(opts, grpc.CallContentSubtype(codecName))
+	if err := c.cc.Invoke(ctx, "/felix.PolicySyncManagement/WorkloadRemoved", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,250 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package proto holds the message and service definitions shared between
+// Felix's PolicySync server and the per-workload dataplane drivers that
+// consume it. It's hand-maintained rather than protoc-generated for now, but
+// follows the same shape protoc-gen-go-grpc would produce so that swapping in
+// a real .proto/codegen pipeline later is a mechanical change.
+package proto
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+)
+
+// SyncRequest is sent once by a workload dataplane driver when it opens a
+// PolicySync stream.
+type SyncRequest struct {
+	SubscriptionType string
+	// Token is the bearer token this workload received from WorkloadAdded on
+	// the management socket; Sync rejects the RPC with codes.Unauthenticated
+	// if it's missing or doesn't match.
+	Token string
+	// Resume carries the last (BootID, Seq) the client successfully applied
+	// from a previous connection to this same stream, if any, letting Felix
+	// replay just the missing deltas instead of a full resync.
+	Resume *ResumeRequest
+}
+
+// ResumeRequest is the resume token a reconnecting client presents.
+type ResumeRequest struct {
+	BootID string
+	Seq    uint64
+}
+
+// ToDataplane is the envelope for every message the PolicySync server pushes
+// down a workload's stream.
+type ToDataplane struct {
+	// BootID identifies the Felix process run that sent this message; it
+	// changes across a Felix restart, invalidating any resume token from
+	// before it.
+	BootID string
+	// SeqNo is monotonically increasing per workload stream, reset only when
+	// Felix restarts, so a client can ask to resume from it.
+	SeqNo uint64
+	// Payload carries the actual update: one of the InSync, ResumeRejected,
+	// ChunkBegin/Chunk/ChunkEnd or WorkloadEndpoint* types below.
+	Payload interface{}
+}
+
+// InSync marks the end of the initial state dump: everything the client has
+// received up to this point is a consistent snapshot.
+type InSync struct{}
+
+// ResumeRejected tells the client that the resume token it presented in
+// SyncRequest.Resume could not be honoured (wrong BootID, or the requested Seq
+// has aged out of Felix's ring buffer), so it must discard state and wait for
+// a full resync.
+type ResumeRejected struct {
+	Reason string
+}
+
+// ChunkBegin starts a chunked transfer of one update whose marshaled size
+// exceeds the configured maximum message size. It's followed by one or more
+// Chunk messages sharing the same TxnID, then a ChunkEnd; the client
+// reassembles Data before dispatching the update.
+type ChunkBegin struct {
+	TxnID      string
+	TotalBytes int
+}
+
+// Chunk carries one slice of a chunked transfer's payload bytes.
+type Chunk struct {
+	TxnID string
+	Data  []byte
+}
+
+// ChunkEnd marks the end of a chunked transfer.
+type ChunkEnd struct {
+	TxnID string
+}
+
+// WorkloadEndpointUpdate announces a workload endpoint's dataplane config.
+type WorkloadEndpointUpdate struct {
+	Id string
+}
+
+// WorkloadEndpointRemove announces that a workload endpoint is gone.
+type WorkloadEndpointRemove struct {
+	Id string
+}
+
+// PolicySyncServer is the interface Felix's policy-sync processor implements;
+// RegisterPolicySyncServer wires an implementation into a *grpc.Server.
+type PolicySyncServer interface {
+	Sync(*SyncRequest, PolicySync_SyncServer) error
+}
+
+// PolicySync_SyncServer is the server-side handle for a single workload's
+// Sync stream.
+type PolicySync_SyncServer interface {
+	Send(*ToDataplane) error
+	grpc.ServerStream
+}
+
+type policySyncSyncServer struct {
+	grpc.ServerStream
+}
+
+func (s *policySyncSyncServer) Send(m *ToDataplane) error {
+	return s.ServerStream.SendMsg(m)
+}
+
+var policySyncServiceDesc = grpc.ServiceDesc{
+	ServiceName: "felix.PolicySync",
+	HandlerType: (*PolicySyncServer)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "Sync",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				req := new(SyncRequest)
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				return srv.(PolicySyncServer).Sync(req, &policySyncSyncServer{stream})
+			},
+			ServerStreams: true,
+		},
+	},
+	Metadata: "felix/proto/policysync.proto",
+}
+
+// RegisterPolicySyncServer registers srv as the handler for the felix.PolicySync
+// service on s.
+func RegisterPolicySyncServer(s *grpc.Server, srv PolicySyncServer) {
+	s.RegisterService(&policySyncServiceDesc, srv)
+}
+
+// PolicySyncClient is the client-side stub for the felix.PolicySync service,
+// returned by NewPolicySyncClient.
+type PolicySyncClient interface {
+	Sync(ctx context.Context, in *SyncRequest, opts ...grpc.CallOption) (PolicySync_SyncClient, error)
+}
+
+// PolicySync_SyncClient is the client-side handle for a single workload's
+// Sync stream. Recv transparently reassembles any ChunkBegin/Chunk/ChunkEnd
+// sequence the server split an oversized update into (see
+// policysync.Processor.sendMsg), so callers only ever see the original
+// payload and never observe the chunk frames themselves.
+type PolicySync_SyncClient interface {
+	Recv() (*ToDataplane, error)
+	grpc.ClientStream
+}
+
+type policySyncClient struct {
+	cc *grpc.ClientConn
+}
+
+// NewPolicySyncClient wraps cc as a PolicySyncClient.
+func NewPolicySyncClient(cc *grpc.ClientConn) PolicySyncClient {
+	return &policySyncClient{cc: cc}
+}
+
+func (c *policySyncClient) Sync(ctx context.Context, in *SyncRequest, opts ...grpc.CallOption) (PolicySync_SyncClient, error) {
+	opts = append(opts, grpc.CallContentSubtype(codecName))
+	stream, err := c.cc.NewStream(ctx, &policySyncServiceDesc.Streams[0], "/felix.PolicySync/Sync", opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return &policySyncSyncClient{ClientStream: stream}, nil
+}
+
+// policySyncSyncClient reassembles chunked transfers before handing a
+// ToDataplane to the caller, so a payload that exceeded the sender's
+// PolicySyncMaxMessageBytes is indistinguishable from one that didn't.
+type policySyncSyncClient struct {
+	grpc.ClientStream
+
+	chunkTxnID string
+	chunkData  []byte
+}
+
+func (c *policySyncSyncClient) Recv() (*ToDataplane, error) {
+	for {
+		m := new(ToDataplane)
+		if err := c.ClientStream.RecvMsg(m); err != nil {
+			return nil, err
+		}
+
+		switch p := m.Payload.(type) {
+		case *ChunkBegin:
+			c.chunkTxnID = p.TxnID
+			c.chunkData = make([]byte, 0, p.TotalBytes)
+			continue
+		case *Chunk:
+			if p.TxnID != c.chunkTxnID {
+				return nil, fmt.Errorf("received chunk for unknown transaction %v", p.TxnID)
+			}
+			c.chunkData = append(c.chunkData, p.Data...)
+			continue
+		case *ChunkEnd:
+			if p.TxnID != c.chunkTxnID {
+				return nil, fmt.Errorf("received chunk end for unknown transaction %v", p.TxnID)
+			}
+			payload, err := UnmarshalPayload(c.chunkData)
+			if err != nil {
+				return nil, err
+			}
+			c.chunkTxnID, c.chunkData = "", nil
+			m.Payload = payload
+			return m, nil
+		default:
+			return m, nil
+		}
+	}
+}
+
+// WorkloadIDFromContext recovers the workload ID a stream interceptor stashed
+// in ctx, for use in logging and metrics. Returns "" if none was stashed.
+func WorkloadIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(workloadIDKey{}).(string)
+	return id
+}
+
+// ContextWithWorkloadID returns a copy of ctx carrying workloadID, retrievable
+// via WorkloadIDFromContext.
+func ContextWithWorkloadID(ctx context.Context, workloadID string) context.Context {
+	return context.WithValue(ctx, workloadIDKey{}, workloadID)
+}
+
+type workloadIDKey struct{}